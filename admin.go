@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/crosbymichael/log"
+	"github.com/crosbymichael/skydock/utils"
+)
+
+// registration is a registered service as returned by the admin api
+type registration struct {
+	Container     string    `json:"container"`
+	UUID          string    `json:"uuid"`
+	Name          string    `json:"name"`
+	Instance      string    `json:"instance"`
+	Host          string    `json:"host"`
+	Port          uint16    `json:"port"`
+	TTL           uint32    `json:"ttl"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+}
+
+// newAdminHandler returns the handler for the admin api
+//
+//	GET    /services                list the registered services
+//	POST   /containers/<id>/sync    register the services of the container again
+//	DELETE /containers/<id>         remove the services of the container
+//	POST   /reconcile               reconcile all the containers
+//	GET    /metrics                 metrics in the prometheus text format
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", adminServices)
+	mux.HandleFunc("/containers/", adminContainer)
+	mux.HandleFunc("/reconcile", adminReconcile)
+	mux.HandleFunc("/metrics", metricsHandler)
+	return mux
+}
+
+func adminServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	containers := registeredServices()
+	sort.Strings(containers)
+
+	out := []registration{}
+	for _, container := range containers {
+		for _, service := range containerServices(container) {
+			out = append(out, registration{
+				Container:     container,
+				UUID:          service.UUID,
+				Name:          service.Name,
+				Instance:      service.Version,
+				Host:          service.Host,
+				Port:          service.Port,
+				TTL:           service.TTL,
+				LastHeartbeat: heartbeats.lastBeat(service.UUID),
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func adminContainer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/containers/"), "/"), "/")
+	if parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	uuid, err := containerUUID(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "DELETE":
+		log.Logf(log.INFO, "removing %s from skydns on request", uuid)
+		if err := removeService(uuid); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case len(parts) == 2 && parts[1] == "sync" && r.Method == "POST":
+		log.Logf(log.INFO, "syncing %s with skydns on request", uuid)
+		if err := syncContainer(uuid); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case len(parts) <= 2:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, containerServices(uuid))
+}
+
+func adminReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := reconcile(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// containerUUID resolves the container id, name or id prefix to the uuid
+// that the container is registered with.  Containers that docker no longer
+// knows can still be removed by their id.
+func containerUUID(name string) (string, error) {
+	container, err := dockerClient.FetchContainer(name, "")
+	if err == nil {
+		return utils.Truncate(container.Id), nil
+	}
+	if uuid := utils.Truncate(name); isRegistered(uuid) {
+		return uuid, nil
+	}
+	return "", err
+}
+
+// syncContainer removes the services of the container and adds them
+// again from the current state of the container
+func syncContainer(uuid string) error {
+	container, err := dockerClient.FetchContainer(uuid, "")
+	if err != nil {
+		return err
+	}
+	if err := removeService(uuid); err != nil {
+		return err
+	}
+	return addService(uuid, container.Config.Image)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Logf(log.ERROR, "error writing admin response: %s", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/crosbymichael/skydock/docker"
+)
+
+func newTestAdmin(t *testing.T) *httptest.Server {
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	registered = make(map[string][]*Service)
+	heartbeats = newScheduler(time.Second, 60)
+	skydns = &mockSkydns{make(map[string]*Service)}
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {
+				Id:    "1",
+				Image: "crosbymichael/redis:latest",
+				Name:  "redis1",
+				Config: &docker.ContainerConfig{
+					Image: "crosbymichael/redis:latest",
+				},
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+				},
+			},
+		},
+	}
+
+	if err := reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(newAdminHandler())
+}
+
+func adminRequest(t *testing.T, method, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAdminServices(t *testing.T) {
+	server := newTestAdmin(t)
+	defer server.Close()
+
+	resp := adminRequest(t, "GET", server.URL+"/services")
+	defer resp.Body.Close()
+
+	var services []registration
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("Expected 1 service got %d", len(services))
+	}
+	service := services[0]
+	if service.Container != "1" || service.UUID != "1" || service.Name != "redis" {
+		t.Fatalf("Expected redis service for container 1 got %v", service)
+	}
+	if service.Host != "192.168.1.10" || service.Port != 80 {
+		t.Fatalf("Expected 192.168.1.10:80 got %s:%d", service.Host, service.Port)
+	}
+	if service.LastHeartbeat.IsZero() {
+		t.Fatal("Expected last heartbeat to be set")
+	}
+}
+
+func TestAdminDeregister(t *testing.T) {
+	server := newTestAdmin(t)
+	defer server.Close()
+
+	resp := adminRequest(t, "DELETE", server.URL+"/containers/1")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d", resp.StatusCode)
+	}
+
+	if isRegistered("1") || skydns.(*mockSkydns).services["1"] != nil {
+		t.Fatal("Expected container 1 to be removed")
+	}
+}
+
+func TestAdminContainerName(t *testing.T) {
+	server := newTestAdmin(t)
+	defer server.Close()
+
+	containers := dockerClient.(*mockDocker).containers
+	containers["redis1"] = containers["1"]
+
+	resp := adminRequest(t, "POST", server.URL+"/containers/redis1/sync")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d", resp.StatusCode)
+	}
+	if !isRegistered("1") || isRegistered("redis1") {
+		t.Fatal("Expected the name to be resolved to container 1")
+	}
+
+	resp = adminRequest(t, "DELETE", server.URL+"/containers/redis1")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d", resp.StatusCode)
+	}
+	if isRegistered("1") {
+		t.Fatal("Expected container 1 to be removed by its name")
+	}
+
+	resp = adminRequest(t, "DELETE", server.URL+"/containers/unknown")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404 for an unknown container got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminSync(t *testing.T) {
+	server := newTestAdmin(t)
+	defer server.Close()
+
+	dockerClient.(*mockDocker).containers["1"].NetworkSettings.IpAddress = "192.168.1.11"
+
+	resp := adminRequest(t, "POST", server.URL+"/containers/1/sync")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d", resp.StatusCode)
+	}
+
+	if host := skydns.(*mockSkydns).services["1"].Host; host != "192.168.1.11" {
+		t.Fatalf("Expected service to be synced to 192.168.1.11 got %s", host)
+	}
+}
+
+func TestAdminReconcile(t *testing.T) {
+	server := newTestAdmin(t)
+	defer server.Close()
+
+	delete(dockerClient.(*mockDocker).containers, "1")
+
+	resp := adminRequest(t, "GET", server.URL+"/reconcile")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status 405 got %d", resp.StatusCode)
+	}
+
+	resp = adminRequest(t, "POST", server.URL+"/reconcile")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 got %d", resp.StatusCode)
+	}
+
+	if isRegistered("1") {
+		t.Fatal("Expected container 1 to be removed on reconcile")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configKeys maps the keys of the config file to the flags they set.  Every
+// key can also be set with an environment variable named SKYDOCK_ followed by
+// the key in upper case with dots and dashes replaced by underscores, for
+// example SKYDOCK_ETCD_URL.  Flags override environment variables which
+// override the config file.
+var configKeys = []struct {
+	key, flag string
+}{
+	{"docker.socket", "s"},
+	{"docker.untagged", "untagged"},
+	{"docker.tls", "tls"},
+	{"docker.tlsverify", "tlsverify"},
+	{"docker.tlscacert", "tlscacert"},
+	{"docker.tlscert", "tlscert"},
+	{"docker.tlskey", "tlskey"},
+	{"domain", "domain"},
+	{"environment", "environment"},
+	{"region", "region"},
+	{"host", "host"},
+	{"networks", "networks"},
+	{"ip", "ip"},
+	{"ttl", "ttl"},
+	{"beat", "beat"},
+	{"workers", "workers"},
+	{"reconcile", "reconcile"},
+	{"deregister", "deregister"},
+	{"stop-timeout", "stop-timeout"},
+	{"admin", "admin"},
+	{"backends", "backend"},
+	{"skydns.url", "skydns"},
+	{"skydns.name", "name"},
+	{"skydns.secret", "secret"},
+	{"dns.listen", "dns"},
+	{"dns.nameservers", "nameserver"},
+	{"etcd.url", "etcd"},
+	{"etcd.prefix", "etcd-prefix"},
+	{"hosts.file", "hosts-file"},
+	{"zone.file", "zone-file"},
+	{"consul.url", "consul"},
+	{"consul.token", "consul-token"},
+	{"rfc2136.server", "rfc2136"},
+	{"rfc2136.key", "secret"},
+	{"plugins.file", "plugins"},
+	{"plugins.fallback", "plugin-fallback"},
+	{"plugins.timeout", "plugin-timeout"},
+	{"plugins.watch", "plugin-watch"},
+	{"filter.include", "include"},
+	{"filter.exclude", "exclude"},
+}
+
+var (
+	// pluginSettings holds the plugins.settings from the config file that
+	// plugins can read from the settings global
+	pluginSettings = make(map[string]interface{})
+
+	// settingSources records where each flag's value came from so that
+	// validation errors can name the setting to fix, flags given on the
+	// command line are recorded as -name
+	settingSources = make(map[string]string)
+)
+
+// loadConfig sets the flags that were not given on the command line from the
+// config file and the environment
+func loadConfig(file string) error {
+	explicit := make(map[string]bool)
+	for name, source := range settingSources {
+		explicit[name] = strings.HasPrefix(source, "-")
+	}
+
+	if file == "" {
+		file = os.Getenv("SKYDOCK_CONFIG")
+	}
+	if file != "" {
+		values, err := readConfig(file)
+		if err != nil {
+			return err
+		}
+
+		set := make(map[string]string)
+		for _, k := range configKeys {
+			value, exists := values[k.key]
+			if !exists || explicit[k.flag] {
+				continue
+			}
+			if other, exists := set[k.flag]; exists && values[other] != value {
+				return fmt.Errorf("%s in %s: conflicts with %s", k.key, file, other)
+			}
+			if err := flag.Set(k.flag, value); err != nil {
+				return fmt.Errorf("%s in %s: invalid value %q", k.key, file, value)
+			}
+			set[k.flag] = k.key
+			settingSources[k.flag] = fmt.Sprintf("%s in %s", k.key, file)
+		}
+	}
+
+	for _, k := range configKeys {
+		name := envName(k.key)
+		value := os.Getenv(name)
+		if value == "" || explicit[k.flag] {
+			continue
+		}
+		if err := flag.Set(k.flag, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q", name, value)
+		}
+		settingSources[k.flag] = name
+	}
+	return nil
+}
+
+// readConfig reads the config file and returns its values keyed by
+// their dotted path.  Lists are joined with commas like the flags take them.
+func readConfig(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	known := make(map[string]bool, len(configKeys))
+	for _, k := range configKeys {
+		known[k.key] = true
+	}
+
+	values := make(map[string]string)
+	if err := flattenConfig(file, "", raw, known, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func flattenConfig(file, prefix string, raw map[string]interface{}, known map[string]bool, values map[string]string) error {
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := prefix + key
+
+		switch v := raw[key].(type) {
+		case map[interface{}]interface{}:
+			nested := make(map[string]interface{}, len(v))
+			for k, value := range v {
+				nested[fmt.Sprint(k)] = value
+			}
+			if path == "plugins.settings" {
+				for k, value := range nested {
+					pluginSettings[k] = value
+				}
+				continue
+			}
+			if err := flattenConfig(file, path+".", nested, known, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			if !known[path] {
+				return fmt.Errorf("%s in %s: unknown key", path, file)
+			}
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[path] = strings.Join(items, ",")
+		case nil:
+			if path == "plugins.settings" {
+				continue
+			}
+			if !known[path] {
+				return fmt.Errorf("%s in %s: unknown key", path, file)
+			}
+			values[path] = ""
+		default:
+			if !known[path] {
+				return fmt.Errorf("%s in %s: unknown key", path, file)
+			}
+			values[path] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable that overrides the config key
+func envName(key string) string {
+	return "SKYDOCK_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// settingName returns where the flag was set, for validation errors
+func settingName(name string) string {
+	if source, exists := settingSources[name]; exists {
+		return source
+	}
+	return "-" + name
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "skydock.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := []interface{}{domain, ttl, backend, etcdUrl, nameservers, secret, deregister, hostIp, region, beat}
+	return file, func() {
+		os.RemoveAll(dir)
+		domain, ttl, backend, etcdUrl = saved[0].(string), saved[1].(int), saved[2].(string), saved[3].(string)
+		nameservers, secret, deregister = saved[4].(string), saved[5].(string), saved[6].(bool)
+		hostIp, region, beat = saved[7].(string), saved[8].(string), saved[9].(int)
+		settingSources = make(map[string]string)
+		pluginSettings = make(map[string]interface{})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file, cleanup := writeConfig(t, `
+domain: docker
+ttl: 30
+deregister: false
+backends: [dns, etcd]
+dns:
+  nameservers:
+    - 8.8.8.8:53
+    - 8.8.4.4:53
+etcd:
+  url: http://10.0.0.1:2379
+plugins:
+  settings:
+    team: infra
+`)
+	defer cleanup()
+
+	os.Setenv("SKYDOCK_ETCD_URL", "http://10.0.0.2:2379")
+	defer os.Unsetenv("SKYDOCK_ETCD_URL")
+
+	// given on the command line so the config file must not change it
+	settingSources["ttl"] = "-ttl"
+	ttl = 45
+
+	if err := loadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if domain != "docker" {
+		t.Fatalf("Expected domain docker got %s", domain)
+	}
+	if ttl != 45 {
+		t.Fatalf("Expected ttl from the command line 45 got %d", ttl)
+	}
+	if deregister {
+		t.Fatal("Expected deregister to be false")
+	}
+	if backend != "dns,etcd" {
+		t.Fatalf("Expected backends dns,etcd got %s", backend)
+	}
+	if nameservers != "8.8.8.8:53,8.8.4.4:53" {
+		t.Fatalf("Expected nameservers 8.8.8.8:53,8.8.4.4:53 got %s", nameservers)
+	}
+	if etcdUrl != "http://10.0.0.2:2379" {
+		t.Fatalf("Expected etcd url from the environment got %s", etcdUrl)
+	}
+	if pluginSettings["team"] != "infra" {
+		t.Fatalf("Expected plugin setting team infra got %v", pluginSettings["team"])
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for content, expected := range map[string]string{
+		"etcd:\n  endpoint: http://127.0.0.1:2379\n": "etcd.endpoint in ",
+		"ttl: soon\n": "ttl in ",
+		"skydns:\n  secret: a\nrfc2136:\n  key: b:c\n":        "rfc2136.key in ",
+		"domain: docker\nbackends: [skydns, dns]\nbeat: -1\n": "",
+	} {
+		file, cleanup := writeConfig(t, content)
+
+		err := loadConfig(file)
+		cleanup()
+
+		if expected == "" {
+			if err != nil {
+				t.Fatalf("Expected %q to be valid got %s", content, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Expected error for %q to start with %q got %v", content, expected, err)
+		}
+	}
+}
+
+func TestValidateSettingsNamesKey(t *testing.T) {
+	file, cleanup := writeConfig(t, "domain: docker\nbackends: [dns, bind]\n")
+	defer cleanup()
+
+	if err := loadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+
+	err := validateSettings()
+	if err == nil || !strings.HasPrefix(err.Error(), "backends in "+file) {
+		t.Fatalf("Expected error naming the backends key got %v", err)
+	}
+
+	backend = "dns"
+	region = "host1"
+	os.Setenv("SKYDOCK_HOST", "10.0.0")
+	defer os.Unsetenv("SKYDOCK_HOST")
+
+	if err := loadConfig(""); err != nil {
+		t.Fatal(err)
+	}
+	err = validateSettings()
+	if err == nil || !strings.HasPrefix(err.Error(), "SKYDOCK_HOST: invalid ip") {
+		t.Fatalf("Expected error naming SKYDOCK_HOST got %v", err)
+	}
+}
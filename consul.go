@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skynetservices/skydns1/client"
+)
+
+// consulClient is a Skydns implementation that registers services with the
+// local consul agent.  Every service is registered with a TTL check that the
+// heartbeat passes so consul marks the service critical if skydock stops.
+type consulClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type consulService struct {
+	ID      string
+	Name    string
+	Tags    []string
+	Address string
+	Port    uint16
+	Check   consulCheck
+}
+
+type consulCheck struct {
+	TTL                            string
+	Status                         string
+	DeregisterCriticalServiceAfter string
+}
+
+func newConsulClient(url, token string) *consulClient {
+	return &consulClient{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Add registers the service with its uuid as the service id and
+// the environment and instance as tags
+func (c *consulClient) Add(uuid string, service *Service) error {
+	tags := []string{service.Environment, service.Version}
+	if service.Region != "" {
+		tags = append(tags, service.Region)
+	}
+	if service.Protocol != "" {
+		tags = append(tags, service.Protocol, strconv.Itoa(int(service.ExposedPort)))
+	}
+
+	// consul does not remove critical services sooner than a minute
+	deregister := 3 * service.TTL
+	if deregister < 60 {
+		deregister = 60
+	}
+
+	return c.put("/v1/agent/service/register", consulService{
+		ID:      uuid,
+		Name:    service.Name,
+		Tags:    tags,
+		Address: service.Host,
+		Port:    service.Port,
+		// checks start critical, which hides the service until the first heartbeat, unless a status is given
+		Check: consulCheck{
+			TTL:                            fmt.Sprintf("%ds", service.TTL),
+			Status:                         "passing",
+			DeregisterCriticalServiceAfter: fmt.Sprintf("%ds", deregister),
+		},
+	})
+}
+
+func (c *consulClient) Delete(uuid string) error {
+	return c.put("/v1/agent/service/deregister/"+uuid, nil)
+}
+
+// Update passes the TTL check of the service.  The check's TTL is set when
+// the service is registered so ttl is ignored.
+func (c *consulClient) Update(uuid string, ttl uint32) error {
+	return c.put("/v1/agent/check/pass/service:"+uuid, nil)
+}
+
+func (c *consulClient) put(path string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("PUT", c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+	// older agents return a 500 for unknown services and checks
+	if resp.StatusCode == http.StatusNotFound || bytes.Contains(msg, []byte("Unknown")) {
+		return client.ErrServiceNotFound
+	}
+	return fmt.Errorf("consul %s returned %d: %s", path, resp.StatusCode, bytes.TrimSpace(msg))
+}
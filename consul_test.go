@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// fakeConsul implements the parts of the consul agent api used by consulClient
+type fakeConsul struct {
+	sync.Mutex
+
+	services map[string]consulService
+	passes   map[string]int
+	token    string
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.token = r.Header.Get("X-Consul-Token")
+
+	switch {
+	case r.Method != "PUT":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case r.URL.Path == "/v1/agent/service/register":
+		var service consulService
+		if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.services[service.ID] = service
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		if _, exists := c.services[id]; !exists {
+			http.Error(w, "Unknown service ID "+id, http.StatusNotFound)
+			return
+		}
+		delete(c.services, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/service:"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/service:")
+		if _, exists := c.services[id]; !exists {
+			http.Error(w, "Unknown check ID service:"+id, http.StatusInternalServerError)
+			return
+		}
+		c.passes[id]++
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulClient(t *testing.T) {
+	consul := &fakeConsul{services: make(map[string]consulService), passes: make(map[string]int)}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	c := newConsulClient(server.URL, "secret")
+
+	service := &Service{
+		Service:     msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", Port: 6379, TTL: 30},
+		Protocol:    "tcp",
+		ExposedPort: 6379,
+	}
+	if err := c.Add("1-6379-tcp", service); err != nil {
+		t.Fatal(err)
+	}
+
+	registered, exists := consul.services["1-6379-tcp"]
+	if !exists {
+		t.Fatal("Service not registered with consul")
+	}
+	if registered.Name != "redis" || registered.Address != "172.17.0.2" || registered.Port != 6379 {
+		t.Fatalf("Expected redis on 172.17.0.2:6379 got %s on %s:%d", registered.Name, registered.Address, registered.Port)
+	}
+	if len(registered.Tags) < 2 || registered.Tags[0] != "dev" || registered.Tags[1] != "redis1" {
+		t.Fatalf("Expected tags dev and redis1 got %v", registered.Tags)
+	}
+	if registered.Check.TTL != "30s" {
+		t.Fatalf("Expected check ttl 30s got %s", registered.Check.TTL)
+	}
+	if registered.Check.Status != "passing" {
+		t.Fatalf("Expected check to start passing got %s", registered.Check.Status)
+	}
+	if consul.token != "secret" {
+		t.Fatalf("Expected token secret got %s", consul.token)
+	}
+
+	if err := c.Update("1-6379-tcp", 30); err != nil {
+		t.Fatal(err)
+	}
+	if consul.passes["1-6379-tcp"] != 1 {
+		t.Fatalf("Expected check to be passed once got %d", consul.passes["1-6379-tcp"])
+	}
+
+	if err := c.Delete("1-6379-tcp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(consul.services) != 0 {
+		t.Fatal("Service not deregistered from consul")
+	}
+
+	if err := c.Update("1-6379-tcp", 30); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected ErrServiceNotFound got %v", err)
+	}
+	if err := c.Delete("1-6379-tcp"); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected ErrServiceNotFound got %v", err)
+	}
+}
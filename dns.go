@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crosbymichael/log"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/client"
+)
+
+// dnsServer is a Skydns implementation that keeps the services in memory and
+// serves them as the authoritative nameserver for the domain.  Queries for
+// other names are forwarded to the nameservers.
+type dnsServer struct {
+	sync.RWMutex
+
+	domain      string
+	nameservers []string
+	services    map[string]*dnsRecord
+}
+
+// dnsRecord holds a copy of the service that is never changed once added
+// so queries can use it after releasing the lock
+type dnsRecord struct {
+	service *Service
+	expires time.Time
+}
+
+func newDNSServer(domain string, nameservers []string) *dnsServer {
+	return &dnsServer{
+		domain:      dns.Fqdn(strings.ToLower(domain)),
+		nameservers: nameservers,
+		services:    make(map[string]*dnsRecord),
+	}
+}
+
+// ListenAndServe serves DNS on both udp and tcp on the addr
+func (s *dnsServer) ListenAndServe(addr string) error {
+	errs := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: addr, Net: network, Handler: s}
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	return <-errs
+}
+
+func (s *dnsServer) Add(uuid string, service *Service) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if r, exists := s.services[uuid]; exists && time.Now().Before(r.expires) {
+		return client.ErrConflictingUUID
+	}
+	copied := *service
+	s.services[uuid] = &dnsRecord{
+		service: &copied,
+		expires: time.Now().Add(time.Duration(service.TTL) * time.Second),
+	}
+	return nil
+}
+
+func (s *dnsServer) Delete(uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.services[uuid]; !exists {
+		return client.ErrServiceNotFound
+	}
+	delete(s.services, uuid)
+	return nil
+}
+
+func (s *dnsServer) Update(uuid string, ttl uint32) error {
+	s.Lock()
+	defer s.Unlock()
+
+	r, exists := s.services[uuid]
+	if !exists {
+		return client.ErrServiceNotFound
+	}
+	updated := *r.service
+	updated.TTL = ttl
+	r.service = &updated
+	r.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	return nil
+}
+
+func (s *dnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		s.reply(w, req, dns.RcodeFormatError, nil, nil)
+		return
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	switch {
+	case dns.IsSubDomain(s.domain, name):
+		answer, extra := s.lookup(name, q.Qtype)
+		if len(answer) == 0 && len(s.matching(name)) == 0 && name != s.domain {
+			s.reply(w, req, dns.RcodeNameError, nil, nil)
+			return
+		}
+		s.reply(w, req, dns.RcodeSuccess, answer, extra)
+	case q.Qtype == dns.TypePTR:
+		if answer := s.reverse(name); len(answer) > 0 {
+			s.reply(w, req, dns.RcodeSuccess, answer, nil)
+			return
+		}
+		s.forward(w, req)
+	default:
+		s.forward(w, req)
+	}
+}
+
+func (s *dnsServer) reply(w dns.ResponseWriter, req *dns.Msg, rcode int, answer, extra []dns.RR) {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	m.Authoritative = true
+	m.RecursionAvailable = len(s.nameservers) > 0
+	m.Answer = answer
+	m.Extra = extra
+	if len(answer) == 0 {
+		m.Ns = []dns.RR{s.soa()}
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		log.Logf(log.ERROR, "error writing dns response: %s", err)
+	}
+}
+
+// forward sends queries for names that we are not authoritative for
+// to the nameservers
+func (s *dnsServer) forward(w dns.ResponseWriter, req *dns.Msg) {
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+
+	c := &dns.Client{Net: network, Timeout: 5 * time.Second}
+	for _, ns := range s.nameservers {
+		resp, _, err := c.Exchange(req, ns)
+		if err != nil {
+			log.Logf(log.ERROR, "error forwarding %s to %s: %s", req.Question[0].Name, ns, err)
+			continue
+		}
+		resp.Compress = true
+		if err := w.WriteMsg(resp); err != nil {
+			log.Logf(log.ERROR, "error writing dns response: %s", err)
+		}
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+func (s *dnsServer) lookup(name string, qtype uint16) (answer, extra []dns.RR) {
+	if name == s.domain && (qtype == dns.TypeSOA || qtype == dns.TypeANY) {
+		answer = append(answer, s.soa())
+	}
+
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+		seen := make(map[string]bool)
+		for _, service := range s.matching(name) {
+			if seen[service.Host] {
+				continue
+			}
+			if rr := addressRecord(name, service); rr != nil && (qtype == dns.TypeANY || rr.Header().Rrtype == qtype) {
+				seen[service.Host] = true
+				answer = append(answer, rr)
+			}
+		}
+	case dns.TypeSRV:
+		seen := make(map[string]bool)
+		for _, service := range s.matching(name) {
+			target := instanceName(service, s.domain)
+			srv := &dns.SRV{
+				Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: service.TTL},
+				Priority: 10,
+				Weight:   10,
+				Port:     service.Port,
+				Target:   target,
+			}
+			if !seen[srvKey(srv)] {
+				seen[srvKey(srv)] = true
+				answer = append(answer, srv)
+			}
+			if rr := addressRecord(target, service); rr != nil && !seen[rr.String()] {
+				seen[rr.String()] = true
+				extra = append(extra, rr)
+			}
+		}
+	}
+	return answer, extra
+}
+
+// reverse returns the PTR records for the address of the reverse name
+func (s *dnsServer) reverse(name string) []dns.RR {
+	var (
+		out  []dns.RR
+		seen = make(map[string]bool)
+	)
+	for _, service := range s.active() {
+		addr, err := dns.ReverseAddr(service.Host)
+		if err != nil || addr != name {
+			continue
+		}
+		target := instanceName(service, s.domain)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		out = append(out, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: service.TTL},
+			Ptr: target,
+		})
+	}
+	return out
+}
+
+// matching returns the services selected by the name.  The labels of the name
+// below the domain are the environment, service, instance and region from
+// right to left and any of them can be a * wildcard.  The name can start with
+// _port._protocol labels to select the services registered for a port.
+func (s *dnsServer) matching(name string) []*Service {
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, s.domain))
+
+	var port, protocol string
+	if len(labels) >= 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		port, protocol = labels[0][1:], labels[1][1:]
+		labels = labels[2:]
+	}
+	if len(labels) == 0 || len(labels) > 4 {
+		return nil
+	}
+
+	var out []*Service
+	for _, service := range s.active() {
+		if port != "" && (port != strconv.Itoa(int(service.ExposedPort)) || protocol != service.Protocol) {
+			continue
+		}
+
+		parts := []string{service.Environment, service.Name, service.Version, service.Region}
+		matches := true
+		for i, label := range labels {
+			if label != "*" && label != strings.ToLower(parts[len(labels)-1-i]) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			out = append(out, service)
+		}
+	}
+	return out
+}
+
+// active returns the services that have not expired
+func (s *dnsServer) active() []*Service {
+	s.RLock()
+	defer s.RUnlock()
+
+	var (
+		out []*Service
+		now = time.Now()
+	)
+	for _, r := range s.services {
+		if now.Before(r.expires) {
+			out = append(out, r.service)
+		}
+	}
+	return out
+}
+
+func (s *dnsServer) soa() dns.RR {
+	return soaRecord(s.domain, uint32(time.Now().Unix()))
+}
+
+// soaRecord returns the SOA record for the domain
+func soaRecord(domain string, serial uint32) *dns.SOA {
+	domain = dns.Fqdn(domain)
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(ttl)},
+		Ns:      "ns." + domain,
+		Mbox:    "hostmaster." + domain,
+		Serial:  serial,
+		Refresh: 28800,
+		Retry:   7200,
+		Expire:  604800,
+		Minttl:  uint32(ttl),
+	}
+}
+
+// instanceName returns the fully qualified name of the service's instance
+// below the domain, redis1.redis.dev.docker.
+func instanceName(service *Service, domain string) string {
+	parts := []string{service.Version, service.Name, service.Environment}
+	if service.Region != "" {
+		parts = append([]string{service.Region}, parts...)
+	}
+	return strings.ToLower(strings.Join(parts, ".")) + "." + dns.Fqdn(domain)
+}
+
+// serviceName returns the fully qualified name of the service below the
+// domain, redis.dev.docker.
+func serviceName(service *Service, domain string) string {
+	return strings.ToLower(service.Name+"."+service.Environment) + "." + dns.Fqdn(domain)
+}
+
+// srvRecord returns the SRV record for the service's port.  Services
+// registered for a port use the port's name, _6379._tcp.redis.dev.docker.
+func srvRecord(service *Service, domain string) *dns.SRV {
+	name := serviceName(service, domain)
+	if service.Protocol != "" {
+		name = fmt.Sprintf("_%d._%s.%s", service.ExposedPort, service.Protocol, name)
+	}
+	return &dns.SRV{
+		Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: service.TTL},
+		Priority: 10,
+		Weight:   10,
+		Port:     service.Port,
+		Target:   instanceName(service, domain),
+	}
+}
+
+// srvKey identifies SRV records that only differ by their ttl, like the
+// records of the ipv4 and ipv6 services of a dual stack container
+func srvKey(srv *dns.SRV) string {
+	return fmt.Sprintf("%s %s %d", srv.Hdr.Name, srv.Target, srv.Port)
+}
+
+// addressRecord returns an A or AAAA record for the service's host
+func addressRecord(name string, service *Service) dns.RR {
+	ip := net.ParseIP(service.Host)
+	if ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: service.TTL},
+			A:   ip4,
+		}
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: service.TTL},
+		AAAA: ip,
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+func startDNSServer(t *testing.T, handler dns.Handler) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+
+	resp, _, err := new(dns.Client).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func newTestDNSServer(t *testing.T, nameservers []string) (*dnsServer, string, func()) {
+	server := newDNSServer("docker", nameservers)
+
+	services := map[string]*Service{
+		"1": {Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", Port: 6379, TTL: 30}, Protocol: "tcp", ExposedPort: 6379},
+		"2": {Service: msg.Service{Name: "redis", Version: "redis2", Environment: "dev", Host: "172.17.0.3", Port: 6379, TTL: 30}, Protocol: "tcp", ExposedPort: 6379},
+		"3": {Service: msg.Service{Name: "web", Version: "web1", Environment: "dev", Host: "fd00::3", Port: 80, TTL: 30}},
+	}
+	for uuid, service := range services {
+		if err := server.Add(uuid, service); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr, stop := startDNSServer(t, server)
+	return server, addr, stop
+}
+
+func TestDNSServerA(t *testing.T) {
+	_, addr, stop := newTestDNSServer(t, nil)
+	defer stop()
+
+	resp := query(t, addr, "redis.dev.docker.", dns.TypeA)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Expected 2 answers got %d", len(resp.Answer))
+	}
+
+	resp = query(t, addr, "redis1.redis.dev.docker.", dns.TypeA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected 1 answer got %d", len(resp.Answer))
+	}
+	if a := resp.Answer[0].(*dns.A); a.A.String() != "172.17.0.2" {
+		t.Fatalf("Expected 172.17.0.2 got %s", a.A)
+	}
+
+	resp = query(t, addr, "web.dev.docker.", dns.TypeAAAA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected 1 answer got %d", len(resp.Answer))
+	}
+	if aaaa := resp.Answer[0].(*dns.AAAA); aaaa.AAAA.String() != "fd00::3" {
+		t.Fatalf("Expected fd00::3 got %s", aaaa.AAAA)
+	}
+
+	if resp = query(t, addr, "postgres.dev.docker.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN got %s", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestDNSServerSRV(t *testing.T) {
+	_, addr, stop := newTestDNSServer(t, nil)
+	defer stop()
+
+	resp := query(t, addr, "_6379._tcp.redis.dev.docker.", dns.TypeSRV)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Expected 2 answers got %d", len(resp.Answer))
+	}
+	for _, rr := range resp.Answer {
+		if srv := rr.(*dns.SRV); srv.Port != 6379 {
+			t.Fatalf("Expected port 6379 got %d", srv.Port)
+		}
+	}
+	if len(resp.Extra) != 2 {
+		t.Fatalf("Expected 2 additional records got %d", len(resp.Extra))
+	}
+
+	if resp = query(t, addr, "_6379._udp.redis.dev.docker.", dns.TypeSRV); len(resp.Answer) != 0 {
+		t.Fatalf("Expected no answers for udp got %d", len(resp.Answer))
+	}
+}
+
+func TestDNSServerPTR(t *testing.T) {
+	_, addr, stop := newTestDNSServer(t, nil)
+	defer stop()
+
+	resp := query(t, addr, "2.0.17.172.in-addr.arpa.", dns.TypePTR)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected 1 answer got %d", len(resp.Answer))
+	}
+	if ptr := resp.Answer[0].(*dns.PTR); ptr.Ptr != "redis1.redis.dev.docker." {
+		t.Fatalf("Expected redis1.redis.dev.docker. got %s", ptr.Ptr)
+	}
+}
+
+func TestDNSServerForward(t *testing.T) {
+	upstream, stopUpstream := startDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("93.184.216.34"),
+		}}
+		w.WriteMsg(m)
+	}))
+	defer stopUpstream()
+
+	_, addr, stop := newTestDNSServer(t, []string{upstream})
+	defer stop()
+
+	resp := query(t, addr, "example.com.", dns.TypeA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected 1 answer got %d", len(resp.Answer))
+	}
+	if a := resp.Answer[0].(*dns.A); a.A.String() != "93.184.216.34" {
+		t.Fatalf("Expected 93.184.216.34 got %s", a.A)
+	}
+}
+
+func TestDNSServerExpire(t *testing.T) {
+	server, addr, stop := newTestDNSServer(t, nil)
+	defer stop()
+
+	if err := server.Update("1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := query(t, addr, "redis.dev.docker.", dns.TypeA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected expired service to be skipped got %d answers", len(resp.Answer))
+	}
+}
+
+func TestDNSServerDualStackSRV(t *testing.T) {
+	server := newDNSServer("docker", nil)
+	for uuid, host := range map[string]string{"1-6379-tcp": "172.17.0.2", "1-ipv6-6379-tcp": "fd00::2"} {
+		service := &Service{Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: host, Port: 6379, TTL: 30}, Protocol: "tcp", ExposedPort: 6379}
+		if err := server.Add(uuid, service); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr, stop := startDNSServer(t, server)
+	defer stop()
+
+	resp := query(t, addr, "_6379._tcp.redis.dev.docker.", dns.TypeSRV)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected 1 SRV record for both addresses got %d", len(resp.Answer))
+	}
+	if len(resp.Extra) != 2 {
+		t.Fatalf("Expected A and AAAA additional records got %d", len(resp.Extra))
+	}
+}
+
+func TestDNSServerUpdateCopies(t *testing.T) {
+	server := newDNSServer("docker", nil)
+
+	service := &Service{Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", Port: 6379, TTL: 30}}
+	if err := server.Add("1", service); err != nil {
+		t.Fatal(err)
+	}
+	before := server.active()[0]
+
+	if err := server.Update("1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if service.TTL != 30 || before.TTL != 30 {
+		t.Fatalf("Expected the added service to be left alone got ttl %d and %d", service.TTL, before.TTL)
+	}
+	if after := server.active()[0]; after.TTL != 60 {
+		t.Fatalf("Expected ttl 60 got %d", after.TTL)
+	}
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,9 +9,10 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"os"
-	"os/signal"
-	"syscall"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/crosbymichael/log"
 	"github.com/crosbymichael/skydock/utils"
@@ -27,12 +29,18 @@ type (
 		ContainerId string `json:"id"`
 		Status      string `json:"status"`
 		Image       string `json:"from"`
+		Time        int64  `json:"time"`
 	}
 
 	ContainerConfig struct {
 		Hostname string
 		Image    string
 		Env      []string
+		Labels   map[string]string
+	}
+
+	HostConfig struct {
+		NetworkMode string
 	}
 
 	Binding struct {
@@ -41,8 +49,17 @@ type (
 	}
 
 	NetworkSettings struct {
-		IpAddress string
-		Ports     map[string][]Binding
+		IpAddress         string
+		GlobalIPv6Address string
+		Ports             map[string][]Binding
+		Networks          map[string]*EndpointSettings
+	}
+
+	// EndpointSettings is the container's address on a network
+	EndpointSettings struct {
+		IPAddress         string
+		GlobalIPv6Address string
+		Aliases           []string
 	}
 
 	// GET /containers/json returns the state of the container, one of:
@@ -59,26 +76,82 @@ type (
 		Image           string
 		Name            string
 		Config          *ContainerConfig
+		HostConfig      *HostConfig
 		NetworkSettings *NetworkSettings
 		State           State
 	}
 
+	Image struct {
+		Id          string
+		RepoTags    []string
+		RepoDigests []string
+	}
+
 	dockerClient struct {
-		path string
+		path          string
+		tlsConfig     *tls.Config
+		resolveImages bool
 	}
 )
 
+// Address returns the legacy ip address of the container or the address on
+// the first network, by name, for containers only on user defined networks
+func (n *NetworkSettings) Address() string {
+	if n.IpAddress != "" {
+		return n.IpAddress
+	}
+
+	names := make([]string, 0, len(n.Networks))
+	for name, network := range n.Networks {
+		if network != nil && network.IPAddress != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return n.Networks[names[0]].IPAddress
+}
+
+// StatusReconnect is the status of the event sent on the event channel after
+// the connection to the events endpoint is re-established.  Consumers should
+// resync their state because events may have been lost while disconnected.
+const StatusReconnect = "skydock:reconnect"
+
 var (
 	ErrImageNotTagged = errors.New("image not tagged")
+
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 60 * time.Second
 )
 
-func NewClient(path string) (Docker, error) {
-	return &dockerClient{path}, nil
+// NewClient returns a client for the docker daemon at path, a unix socket or
+// a tcp:// or https:// address.  Connections to tcp addresses use tlsConfig if
+// it is not nil, https addresses always use tls.  When resolveImages is true
+// containers started from an image id or digest are returned with the image's
+// repository name instead of failing with ErrImageNotTagged.
+func NewClient(path string, tlsConfig *tls.Config, resolveImages bool) (Docker, error) {
+	if strings.HasPrefix(path, "https://") {
+		path = "tcp://" + strings.TrimPrefix(path, "https://")
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	}
+	return &dockerClient{path, tlsConfig, resolveImages}, nil
 }
 
 func (d *dockerClient) newConn() (*httputil.ClientConn, error) {
-	prot, path := utils.SplitURI(d.path)
-	conn, err := net.Dial(prot, path)
+	var (
+		conn       net.Conn
+		err        error
+		prot, path = utils.SplitURI(d.path)
+	)
+	if prot == "tcp" && d.tlsConfig != nil {
+		conn, err = tls.Dial(prot, path, d.tlsConfig)
+	} else {
+		conn, err = net.Dial(prot, path)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -106,15 +179,19 @@ func (d *dockerClient) FetchContainer(name, image string) (*Container, error) {
 	if resp.StatusCode == http.StatusOK {
 		var (
 			container *Container
-			d         = json.NewDecoder(resp.Body)
+			decoder   = json.NewDecoder(resp.Body)
 		)
 
-		if err = d.Decode(&container); err != nil {
+		if err = decoder.Decode(&container); err != nil {
 			return nil, err
 		}
 
-		// These should match or else it's from an image that is not tagged
-		if image != "" && utils.RemoveTag(image) != utils.RemoveTag(container.Config.Image) {
+		if image != "" && d.resolveImages {
+			if image, err = d.resolveImage(image, container.Config.Image); err != nil {
+				return nil, err
+			}
+		} else if image != "" && utils.RemoveTag(image) != utils.RemoveTag(container.Config.Image) {
+			// These should match or else it's from an image that is not tagged
 			return nil, ErrImageNotTagged
 		}
 		container.Image = image
@@ -124,6 +201,78 @@ func (d *dockerClient) FetchContainer(name, image string) (*Container, error) {
 	return nil, fmt.Errorf("Could not fetch container %d", resp.StatusCode)
 }
 
+// resolveImage returns a repository name for an image referenced by id or
+// digest.  Images without any repository fall back to the name the container
+// was created with or else the short image id.
+func (d *dockerClient) resolveImage(image, configured string) (string, error) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i], nil
+	}
+	if !isImageID(image) {
+		return image, nil
+	}
+
+	info, err := d.fetchImage(image)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range info.RepoTags {
+		if tag != "<none>:<none>" {
+			return tag, nil
+		}
+	}
+	for _, digest := range info.RepoDigests {
+		if i := strings.Index(digest, "@"); i > 0 && digest[:i] != "<none>" {
+			return digest[:i], nil
+		}
+	}
+
+	if configured != "" && !isImageID(configured) {
+		return d.resolveImage(configured, "")
+	}
+
+	id := strings.TrimPrefix(info.Id, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id, nil
+}
+
+func (d *dockerClient) fetchImage(name string) (*Image, error) {
+	c, err := d.newConn()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("/images/%s/json", name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var image *Image
+		if err = json.NewDecoder(resp.Body).Decode(&image); err != nil {
+			return nil, err
+		}
+		return image, nil
+	}
+	return nil, fmt.Errorf("Could not fetch image %d", resp.StatusCode)
+}
+
+var imageID = regexp.MustCompile(`^(sha256:)?[0-9a-f]{12,64}$`)
+
+// isImageID returns true if the image is referenced by its full or short id
+func isImageID(image string) bool {
+	return imageID.MatchString(image)
+}
+
 func (d *dockerClient) FetchAllContainers() ([]*Container, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("/containers/json"), nil)
 	if err != nil {
@@ -152,57 +301,89 @@ func (d *dockerClient) FetchAllContainers() ([]*Container, error) {
 	return nil, fmt.Errorf("invalid HTTP request %d %s", resp.StatusCode, resp.Status)
 }
 
+// GetEvents streams docker events on the returned channel.  When the connection
+// to docker is lost it reconnects with backoff and replays the events that
+// happened since the last one received.
 func (d *dockerClient) GetEvents() chan *Event {
 	eventChan := make(chan *Event, 100) // 100 event buffer
 	go func() {
-		defer close(eventChan)
-
-		c, err := d.newConn()
-		if err != nil {
-			log.Logf(log.FATAL, "cannot connect to docker: %s", err)
-			return
-		}
-		defer c.Close()
-
-		req, err := http.NewRequest("GET", "/events", nil)
-		if err != nil {
-			log.Logf(log.ERROR, "bad request for events: %s", err)
-			return
-		}
+		var (
+			since int64
+			delay = minReconnectDelay
+		)
+		for attempt := 0; ; attempt++ {
+			last, err := d.streamEvents(since, eventChan, func() {
+				delay = minReconnectDelay
+				if attempt > 0 {
+					eventChan <- &Event{Status: StatusReconnect}
+				}
+			})
+			if last > 0 {
+				since = last
+			}
 
-		resp, err := c.Do(req)
-		if err != nil {
-			log.Logf(log.FATAL, "cannot connect to events endpoint: %s", err)
-			return
-		}
-		defer resp.Body.Close()
-
-		// handle signals to stop the socket
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-		go func() {
-			for sig := range sigChan {
-				log.Logf(log.INFO, "received signal '%v', exiting", sig)
-
-				c.Close()
-				close(eventChan)
-				os.Exit(0)
+			if err != nil {
+				log.Logf(log.ERROR, "error reading docker events: %s", err)
+			} else {
+				log.Logf(log.INFO, "docker closed the event stream")
 			}
-		}()
-
-		dec := json.NewDecoder(resp.Body)
-		for {
-			var event *Event
-			if err := dec.Decode(&event); err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Logf(log.ERROR, "cannot decode json: %s", err)
-				continue
+			log.Logf(log.INFO, "reconnecting to docker events in %s", delay)
+
+			time.Sleep(delay)
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
 			}
-			eventChan <- event
 		}
-		log.Logf(log.DEBUG, "closing event channel")
 	}()
 	return eventChan
 }
+
+// streamEvents connects to the events endpoint and sends every event received
+// to eventChan until the stream ends.  connected is called once the stream is
+// established.  The timestamp of the last event received is returned.
+func (d *dockerClient) streamEvents(since int64, eventChan chan *Event, connected func()) (int64, error) {
+	c, err := d.newConn()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	path := "/events"
+	if since > 0 {
+		path = fmt.Sprintf("/events?since=%d", since)
+	}
+
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("invalid HTTP request %d %s", resp.StatusCode, resp.Status)
+	}
+	connected()
+
+	var (
+		last int64
+		dec  = json.NewDecoder(resp.Body)
+	)
+	for {
+		var event *Event
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return last, nil
+			}
+			return last, err
+		}
+		if event.Time > last {
+			last = event.Time
+		}
+		eventChan <- event
+	}
+}
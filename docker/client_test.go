@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDaemon(t *testing.T, handler http.Handler) (string, func()) {
+	dir, err := ioutil.TempDir("", "skydock-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "docker.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, handler)
+
+	return path, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func receiveEvent(t *testing.T, events chan *Event) *Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return nil
+}
+
+func TestGetEventsReconnect(t *testing.T) {
+	defer func(d time.Duration) { minReconnectDelay = d }(minReconnectDelay)
+	minReconnectDelay = 10 * time.Millisecond
+
+	var (
+		requests = make(chan string, 10)
+		handler  = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r.URL.RawQuery
+			switch r.URL.RawQuery {
+			case "":
+				// first connection sends one event then drops the stream
+				fmt.Fprint(w, `{"id":"1","status":"start","from":"redis","time":100}`)
+			case "since=100":
+				fmt.Fprint(w, `{"id":"2","status":"die","from":"redis","time":105}`)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		})
+	)
+
+	path, cleanup := newTestDaemon(t, handler)
+	defer cleanup()
+
+	client, err := NewClient(path, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := client.GetEvents()
+
+	if event := receiveEvent(t, events); event.ContainerId != "1" || event.Time != 100 {
+		t.Fatalf("Expected event for container 1 at 100 got %v", event)
+	}
+
+	if event := receiveEvent(t, events); event.Status != StatusReconnect {
+		t.Fatalf("Expected status %s got %s", StatusReconnect, event.Status)
+	}
+
+	if event := receiveEvent(t, events); event.ContainerId != "2" || event.Status != "die" {
+		t.Fatalf("Expected die event for container 2 got %v", event)
+	}
+
+	if query := <-requests; query != "" {
+		t.Fatalf("Expected no query on first connect got %s", query)
+	}
+	if query := <-requests; query != "since=100" {
+		t.Fatalf("Expected since=100 on reconnect got %s", query)
+	}
+}
+
+func TestFetchContainerUntagged(t *testing.T) {
+	const id = "sha256:4e38e38c8ce0b8d9041a9c4fefe786631d1416225e13b0bfe8cfa2321aec4bba"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/1/json":
+			fmt.Fprintf(w, `{"Id":"1","Name":"/redis1","Config":{"Image":"%s"}}`, id)
+		case "/containers/2/json":
+			fmt.Fprint(w, `{"Id":"2","Name":"/redis2","Config":{"Image":"crosbymichael/redis@sha256:abc"}}`)
+		case "/containers/3/json":
+			fmt.Fprint(w, `{"Id":"3","Name":"/redis3","Config":{"Image":"4e38e38c8ce0"}}`)
+		case "/images/" + id + "/json":
+			fmt.Fprintf(w, `{"Id":"%s","RepoTags":["<none>:<none>","crosbymichael/redis:latest"]}`, id)
+		case "/images/4e38e38c8ce0/json":
+			fmt.Fprintf(w, `{"Id":"%s","RepoTags":[],"RepoDigests":[]}`, id)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	path, cleanup := newTestDaemon(t, handler)
+	defer cleanup()
+
+	strict, _ := NewClient(path, nil, false)
+	if _, err := strict.FetchContainer("1", "crosbymichael/redis:latest"); err != ErrImageNotTagged {
+		t.Fatalf("Expected %s without resolving images got %v", ErrImageNotTagged, err)
+	}
+
+	client, _ := NewClient(path, nil, true)
+	for _, test := range []struct {
+		name, image, expected string
+	}{
+		{"1", id, "crosbymichael/redis:latest"},
+		{"1", "crosbymichael/redis:latest", "crosbymichael/redis:latest"},
+		{"2", "crosbymichael/redis@sha256:abc", "crosbymichael/redis"},
+		{"3", "4e38e38c8ce0", "4e38e38c8ce0"},
+	} {
+		container, err := client.FetchContainer(test.name, test.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if container.Image != test.expected {
+			t.Fatalf("Expected image %s for container %s got %s", test.expected, test.name, container.Image)
+		}
+	}
+}
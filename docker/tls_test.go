@@ -0,0 +1,80 @@
+package docker
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTLSClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			fmt.Fprint(w, `[{"Id":"1","Image":"crosbymichael/redis"}]`)
+		case "/events":
+			fmt.Fprint(w, `{"id":"1","status":"start","from":"redis","time":100}`)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "skydock-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := NewTLSConfig(ca, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := "tcp://" + strings.TrimPrefix(server.URL, "https://")
+	client, err := NewClient(host, config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers, err := client.FetchAllContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].Id != "1" {
+		t.Fatalf("Expected container 1 got %v", containers)
+	}
+
+	if event := receiveEvent(t, client.GetEvents()); event.ContainerId != "1" || event.Status != "start" {
+		t.Fatalf("Expected start event for container 1 got %v", event)
+	}
+
+	// without the ca the daemon's certificate cannot be verified
+	untrusted, _ := NewClient(server.URL, nil, false)
+	if _, err := untrusted.FetchAllContainers(); err == nil {
+		t.Fatal("Expected error for unverified certificate")
+	}
+}
+
+func TestNewTLSConfigMissingCA(t *testing.T) {
+	if _, err := NewTLSConfig("/nonexistent/ca.pem", "", "", true); err == nil {
+		t.Fatal("Expected error for missing ca certificate")
+	}
+
+	config, err := NewTLSConfig("/nonexistent/ca.pem", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.InsecureSkipVerify {
+		t.Fatal("Expected certificate not to be verified without tlsverify")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns1/client"
+)
+
+// etcdClient is a Skydns implementation that writes services to etcd in the
+// path layout used by SkyDNS2 and the CoreDNS etcd plugin.  Each service is
+// attached to an etcd lease with the service's ttl which the heartbeat keeps
+// alive instead of refreshing the ttl of the record.
+type etcdClient struct {
+	sync.Mutex
+
+	url    string
+	prefix string
+	domain string
+	leases map[string]string // uuid -> lease id
+	client *http.Client
+}
+
+// etcdService is the value of a service's key read by SkyDNS2 and CoreDNS
+type etcdService struct {
+	Host     string `json:"host"`
+	Port     uint16 `json:"port,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+type etcdLease struct {
+	ID  json.Number `json:"ID"`
+	TTL json.Number `json:"TTL"`
+}
+
+func newEtcdClient(url, prefix, domain string) *etcdClient {
+	return &etcdClient{
+		url:    strings.TrimSuffix(url, "/"),
+		prefix: "/" + strings.Trim(prefix, "/"),
+		domain: domain,
+		leases: make(map[string]string),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *etcdClient) Add(uuid string, service *Service) error {
+	c.Lock()
+	if _, exists := c.leases[uuid]; exists {
+		c.Unlock()
+		return client.ErrConflictingUUID
+	}
+	// reserve the uuid so a concurrent Add does not grant a second lease
+	c.leases[uuid] = ""
+	c.Unlock()
+
+	id, err := c.put(uuid, service)
+
+	c.Lock()
+	defer c.Unlock()
+	if err != nil {
+		delete(c.leases, uuid)
+		return err
+	}
+	c.leases[uuid] = id
+	return nil
+}
+
+// put writes the key of the service attached to a new lease and
+// returns the lease's id
+func (c *etcdClient) put(uuid string, service *Service) (string, error) {
+	var lease etcdLease
+	if err := c.call("/v3/lease/grant", map[string]interface{}{"TTL": service.TTL}, &lease); err != nil {
+		return "", err
+	}
+
+	value, err := json.Marshal(etcdService{
+		Host:     service.Host,
+		Port:     service.Port,
+		Priority: 10,
+		Weight:   10,
+		TTL:      service.TTL,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.call("/v3/kv/put", map[string]interface{}{
+		"key":   base64.StdEncoding.EncodeToString([]byte(c.key(uuid, service))),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": lease.ID,
+	}, nil); err != nil {
+		c.call("/v3/lease/revoke", map[string]interface{}{"ID": lease.ID}, nil)
+		return "", err
+	}
+	return lease.ID.String(), nil
+}
+
+// Delete revokes the lease of the service which removes its key
+func (c *etcdClient) Delete(uuid string) error {
+	c.Lock()
+	id := c.leases[uuid]
+	if id == "" {
+		// not added or still being added
+		c.Unlock()
+		return client.ErrServiceNotFound
+	}
+	delete(c.leases, uuid)
+	c.Unlock()
+	return c.call("/v3/lease/revoke", map[string]interface{}{"ID": id}, nil)
+}
+
+// Update keeps the lease of the service alive.  etcd resets the lease to
+// the ttl it was granted with so ttl is ignored.
+func (c *etcdClient) Update(uuid string, ttl uint32) error {
+	c.Lock()
+	id := c.leases[uuid]
+	c.Unlock()
+	if id == "" {
+		return client.ErrServiceNotFound
+	}
+
+	var resp struct {
+		Result etcdLease `json:"result"`
+	}
+	if err := c.call("/v3/lease/keepalive", map[string]interface{}{"ID": id}, &resp); err != nil {
+		return err
+	}
+
+	if remaining, _ := resp.Result.TTL.Int64(); remaining <= 0 {
+		// the lease expired and took the key with it
+		c.Lock()
+		if c.leases[uuid] == id {
+			delete(c.leases, uuid)
+		}
+		c.Unlock()
+		return client.ErrServiceNotFound
+	}
+	return nil
+}
+
+// key returns the path of the service, the domain reversed followed by the
+// environment, service and instance name, /skydns/docker/dev/redis/redis1/<uuid>.
+// Services for a port are stored under the port's SRV name,
+// redis/_tcp/_6379/redis1/<uuid>.
+func (c *etcdClient) key(uuid string, service *Service) string {
+	parts := []string{c.prefix}
+
+	labels := strings.Split(strings.Trim(c.domain, "."), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		parts = append(parts, labels[i])
+	}
+	parts = append(parts, service.Environment, service.Name)
+
+	if service.Protocol != "" {
+		parts = append(parts, "_"+service.Protocol, "_"+strconv.Itoa(int(service.ExposedPort)))
+	}
+	if service.Version != "" {
+		parts = append(parts, service.Version)
+	}
+	return strings.ToLower(strings.Join(append(parts, uuid), "/"))
+}
+
+// call posts the request to the etcd v3 json api and decodes the response
+func (c *etcdClient) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.client.Post(c.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&e)
+		return fmt.Errorf("etcd %s returned %d: %s", path, r.StatusCode, e.Message)
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
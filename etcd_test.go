@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// fakeEtcd implements the parts of the etcd v3 json api used by etcdClient
+type fakeEtcd struct {
+	sync.Mutex
+
+	nextID int64
+	leases map[string][]string // lease id -> keys
+	keys   map[string]string
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := func(name string) string {
+		switch v := req[name].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return ""
+	}
+
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		e.nextID++
+		lease := strconv.FormatInt(e.nextID, 10)
+		e.leases[lease] = nil
+		json.NewEncoder(w).Encode(map[string]string{"ID": lease, "TTL": "30"})
+	case "/v3/kv/put":
+		key, _ := base64.StdEncoding.DecodeString(req["key"].(string))
+		value, _ := base64.StdEncoding.DecodeString(req["value"].(string))
+		lease := id("lease")
+		if _, exists := e.leases[lease]; !exists {
+			http.Error(w, `{"message":"requested lease not found"}`, http.StatusNotFound)
+			return
+		}
+		e.keys[string(key)] = string(value)
+		e.leases[lease] = append(e.leases[lease], string(key))
+		w.Write([]byte("{}"))
+	case "/v3/lease/keepalive":
+		result := map[string]string{"ID": id("ID")}
+		if _, exists := e.leases[id("ID")]; exists {
+			result["TTL"] = "30"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+	case "/v3/lease/revoke":
+		lease := id("ID")
+		for _, key := range e.leases[lease] {
+			delete(e.keys, key)
+		}
+		delete(e.leases, lease)
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdClient(t *testing.T) {
+	etcd := &fakeEtcd{leases: make(map[string][]string), keys: make(map[string]string)}
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	c := newEtcdClient(server.URL, "/skydns", "docker")
+
+	service := &Service{
+		Service:     msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", Port: 6379, TTL: 30},
+		Protocol:    "tcp",
+		ExposedPort: 6379,
+	}
+	if err := c.Add("1-6379-tcp", service); err != nil {
+		t.Fatal(err)
+	}
+
+	value, exists := etcd.keys["/skydns/docker/dev/redis/_tcp/_6379/redis1/1-6379-tcp"]
+	if !exists {
+		t.Fatalf("Expected key for service got %v", etcd.keys)
+	}
+
+	var record etcdService
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Host != "172.17.0.2" || record.Port != 6379 {
+		t.Fatalf("Expected 172.17.0.2:6379 got %s:%d", record.Host, record.Port)
+	}
+
+	if err := c.Update("1-6379-tcp", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete("1-6379-tcp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(etcd.keys) != 0 {
+		t.Fatalf("Expected key removed with lease got %v", etcd.keys)
+	}
+
+	if err := c.Update("1-6379-tcp", 30); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected ErrServiceNotFound got %v", err)
+	}
+}
+
+func TestEtcdKey(t *testing.T) {
+	c := newEtcdClient("http://127.0.0.1:2379", "skydns/", "crosbymichael.com")
+
+	service := &Service{Service: msg.Service{Name: "webapp", Environment: "production"}}
+	if key := c.key("1", service); key != "/skydns/com/crosbymichael/production/webapp/1" {
+		t.Fatalf("Expected /skydns/com/crosbymichael/production/webapp/1 got %s", key)
+	}
+
+	service.Version = "Web1"
+	if key := c.key("1", service); key != "/skydns/com/crosbymichael/production/webapp/web1/1" {
+		t.Fatalf("Expected /skydns/com/crosbymichael/production/webapp/web1/1 got %s", key)
+	}
+}
+
+func TestEtcdConcurrentAdd(t *testing.T) {
+	etcd := &fakeEtcd{leases: make(map[string][]string), keys: make(map[string]string)}
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	c := newEtcdClient(server.URL, "/skydns", "docker")
+	service := &Service{Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", Port: 6379, TTL: 30}}
+
+	var (
+		group sync.WaitGroup
+		added = make(chan error, 5)
+	)
+	for i := 0; i < 5; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			added <- c.Add("1", service)
+		}()
+	}
+	group.Wait()
+	close(added)
+
+	var ok int
+	for err := range added {
+		if err == nil {
+			ok++
+		} else if err != client.ErrConflictingUUID {
+			t.Fatal(err)
+		}
+	}
+	if ok != 1 || len(etcd.leases) != 1 {
+		t.Fatalf("Expected 1 add and 1 lease got %d adds and %d leases", ok, len(etcd.leases))
+	}
+}
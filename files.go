@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// fileBackend is a Skydns implementation that keeps the services in memory
+// and rewrites a file rendered from them every time a service is added or
+// removed.  The file is replaced atomically so readers never see a partial file.
+type fileBackend struct {
+	sync.Mutex
+
+	path     string
+	domain   string
+	services map[string]*Service
+	render   func(w io.Writer, services []*Service) error
+}
+
+// newHostsFile returns a backend that writes the services to an /etc/hosts
+// style file that dnsmasq or plain resolvers can read
+func newHostsFile(path, domain string) (*fileBackend, error) {
+	b := &fileBackend{
+		path:     path,
+		domain:   strings.ToLower(domain),
+		services: make(map[string]*Service),
+	}
+	b.render = b.renderHosts
+	return b, b.write()
+}
+
+// newZoneFile returns a backend that writes the services to an RFC 1035 zone
+// file for the domain that BIND or the CoreDNS file plugin can serve.  The
+// serial of the SOA record is increased on every write.
+func newZoneFile(path, domain string) (*fileBackend, error) {
+	b := &fileBackend{
+		path:     path,
+		domain:   strings.ToLower(domain),
+		services: make(map[string]*Service),
+	}
+
+	serial := uint32(time.Now().Unix())
+	b.render = func(w io.Writer, services []*Service) error {
+		serial++
+		return b.renderZone(w, serial, services)
+	}
+	return b, b.write()
+}
+
+func (b *fileBackend) Add(uuid string, service *Service) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; exists {
+		return client.ErrConflictingUUID
+	}
+	b.services[uuid] = service
+
+	if err := b.write(); err != nil {
+		delete(b.services, uuid)
+		return err
+	}
+	return nil
+}
+
+func (b *fileBackend) Delete(uuid string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	service, exists := b.services[uuid]
+	if !exists {
+		return client.ErrServiceNotFound
+	}
+	delete(b.services, uuid)
+
+	if err := b.write(); err != nil {
+		b.services[uuid] = service
+		return err
+	}
+	return nil
+}
+
+// Update does not change the file because records in the file do not expire
+func (b *fileBackend) Update(uuid string, ttl uint32) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; !exists {
+		return client.ErrServiceNotFound
+	}
+	return nil
+}
+
+// write renders the services to a temporary file next to the file
+// and renames it over the file
+func (b *fileBackend) write() error {
+	uuids := make([]string, 0, len(b.services))
+	for uuid := range b.services {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	services := make([]*Service, len(uuids))
+	for i, uuid := range uuids {
+		services[i] = b.services[uuid]
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(b.path), "."+filepath.Base(b.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	if err := b.render(w, services); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), b.path)
+}
+
+// renderHosts writes a line for every address with the instance and
+// service names of the services on that address
+func (b *fileBackend) renderHosts(w io.Writer, services []*Service) error {
+	var (
+		hosts []string
+		names = make(map[string][]string)
+	)
+	for _, service := range services {
+		if _, exists := names[service.Host]; !exists {
+			hosts = append(hosts, service.Host)
+		}
+		for _, name := range []string{instanceName(service, b.domain), serviceName(service, b.domain)} {
+			name = strings.TrimSuffix(name, ".")
+			if !containsString(names[service.Host], name) {
+				names[service.Host] = append(names[service.Host], name)
+			}
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "# generated by skydock, do not edit\n"); err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", host, strings.Join(names[host], " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderZone writes the SOA and NS records followed by the address and
+// SRV records of the services.  The nameserver of the SOA record gets the
+// -host address, or localhost, as glue because BIND does not load a zone
+// without an NS record that it can resolve.
+func (b *fileBackend) renderZone(w io.Writer, serial uint32, services []*Service) error {
+	var (
+		origin = dns.Fqdn(b.domain)
+		soa    = soaRecord(origin, serial)
+	)
+
+	nsHost := hostIp
+	if net.ParseIP(nsHost) == nil {
+		nsHost = "127.0.0.1"
+	}
+	records := []dns.RR{
+		soa,
+		&dns.NS{Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: soa.Hdr.Ttl}, Ns: soa.Ns},
+		addressRecord(soa.Ns, &Service{Service: msg.Service{Host: nsHost, TTL: soa.Hdr.Ttl}}),
+	}
+	seen := make(map[string]bool)
+	for _, service := range services {
+		for _, name := range []string{instanceName(service, b.domain), serviceName(service, b.domain)} {
+			if rr := addressRecord(name, service); rr != nil && !seen[rr.String()] {
+				seen[rr.String()] = true
+				records = append(records, rr)
+			}
+		}
+		// the ipv4 and ipv6 services of a container have the same SRV record
+		if srv := srvRecord(service, b.domain); !seen[srvKey(srv)] {
+			seen[srvKey(srv)] = true
+			records = append(records, srv)
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "; generated by skydock, do not edit\n$ORIGIN %s\n$TTL %d\n", origin, ttl); err != nil {
+		return err
+	}
+	for _, rr := range records {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
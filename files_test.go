@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+func newTestFileServices() map[string]*Service {
+	return map[string]*Service{
+		"1-6379-tcp": {Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", Port: 6379, TTL: 30}, Protocol: "tcp", ExposedPort: 6379},
+		"2":          {Service: msg.Service{Name: "web", Version: "web1", Environment: "dev", Host: "172.17.0.3", Port: 80, TTL: 30}},
+	}
+}
+
+func TestZoneFileDualStack(t *testing.T) {
+	b := &fileBackend{domain: "docker"}
+	services := []*Service{
+		{Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", Port: 6379, TTL: 30}, Protocol: "tcp", ExposedPort: 6379},
+		{Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "fd00::2", Port: 6379, TTL: 30}, Protocol: "tcp", ExposedPort: 6379},
+	}
+
+	var buf bytes.Buffer
+	if err := b.renderZone(&buf, 1, services); err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(buf.String(), "\tSRV\t"); count != 1 {
+		t.Fatalf("Expected 1 SRV record for both addresses got %d in %s", count, buf.String())
+	}
+	if !strings.Contains(buf.String(), "\tAAAA\tfd00::2") {
+		t.Fatalf("Expected AAAA record got %s", buf.String())
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydock-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	b, err := newHostsFile(path, "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for uuid, service := range newTestFileServices() {
+		if err := b.Add(uuid, service); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "172.17.0.2\tredis1.redis.dev.docker redis.dev.docker\n") {
+		t.Fatalf("Expected line for redis got %s", content)
+	}
+
+	if err := b.Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "172.17.0.3") {
+		t.Fatalf("Expected web to be removed got %s", content)
+	}
+}
+
+func TestZoneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydock-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "zone")
+	b, err := newZoneFile(path, "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var serial uint32
+	for uuid, service := range newTestFileServices() {
+		if err := b.Add(uuid, service); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			records = make(map[uint16][]dns.RR)
+			zp      = dns.NewZoneParser(f, "", path)
+		)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			records[rr.Header().Rrtype] = append(records[rr.Header().Rrtype], rr)
+		}
+		f.Close()
+		if err := zp.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if ns := records[dns.TypeNS]; len(ns) != 1 || ns[0].(*dns.NS).Ns != "ns.docker." {
+			t.Fatalf("Expected NS record for ns.docker. got %v", ns)
+		}
+		if glue := records[dns.TypeA]; len(glue) == 0 || glue[0].Header().Name != "ns.docker." {
+			t.Fatalf("Expected glue record for ns.docker. got %v", glue)
+		}
+
+		soa := records[dns.TypeSOA][0].(*dns.SOA)
+		if soa.Serial <= serial {
+			t.Fatalf("Expected serial to increase from %d got %d", serial, soa.Serial)
+		}
+		serial = soa.Serial
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "_6379._tcp.redis.dev.docker.\t30\tIN\tSRV\t10 10 6379 redis1.redis.dev.docker.") {
+		t.Fatalf("Expected SRV record for redis got %s", content)
+	}
+}
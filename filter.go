@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/crosbymichael/skydock/docker"
+	"github.com/crosbymichael/skydock/utils"
+)
+
+// filterRule matches containers on one of:
+//
+//	image:<glob>             the image name, without the tag if the glob has none
+//	                         and without the repository if the glob has no /
+//	name:<regexp>            the container name
+//	label:<key>[=<value>]    a label, with any value if none is given
+//	network:<name>           a network the container is connected to
+type filterRule struct {
+	kind  string
+	value string
+	re    *regexp.Regexp
+}
+
+// containerFilter decides which containers are registered.  A container is
+// registered if it matches one of the include rules, or there are none, and
+// does not match any of the exclude rules.
+type containerFilter struct {
+	include []*filterRule
+	exclude []*filterRule
+}
+
+// newContainerFilter parses the comma separated include and exclude rules
+func newContainerFilter(include, exclude string) (*containerFilter, error) {
+	var (
+		f   = &containerFilter{}
+		err error
+	)
+	if f.include, err = parseFilterRules(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = parseFilterRules(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseFilterRules(rules string) ([]*filterRule, error) {
+	var out []*filterRule
+	for _, rule := range strings.Split(rules, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid rule '%s', expected image:, name:, label: or network:", rule)
+		}
+
+		r := &filterRule{kind: parts[0], value: parts[1]}
+		switch r.kind {
+		case "image":
+			if _, err := path.Match(r.value, ""); err != nil {
+				return nil, fmt.Errorf("invalid image glob '%s': %s", r.value, err)
+			}
+		case "name":
+			re, err := regexp.Compile(r.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid name regexp '%s': %s", r.value, err)
+			}
+			r.re = re
+		case "label", "network":
+		default:
+			return nil, fmt.Errorf("invalid rule '%s', expected image:, name:, label: or network:", rule)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// allow returns if the container should be registered and
+// the rule that decided it
+func (f *containerFilter) allow(container *docker.Container) (bool, string) {
+	for _, r := range f.exclude {
+		if r.match(container) {
+			return false, "excluded by " + r.String()
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true, ""
+	}
+	for _, r := range f.include {
+		if r.match(container) {
+			return true, "included by " + r.String()
+		}
+	}
+	return false, "not included by any rule"
+}
+
+func (r *filterRule) match(container *docker.Container) bool {
+	switch r.kind {
+	case "image":
+		image := container.Image
+		if !strings.Contains(r.value, ":") {
+			image = utils.RemoveTag(image)
+		}
+		// * does not match across / so match globs without one on the last part
+		if !strings.Contains(r.value, "/") {
+			image = path.Base(image)
+		}
+		matched, _ := path.Match(r.value, image)
+		return matched
+	case "name":
+		return r.re.MatchString(strings.TrimPrefix(container.Name, "/"))
+	case "label":
+		if container.Config == nil {
+			return false
+		}
+		parts := strings.SplitN(r.value, "=", 2)
+		value, exists := container.Config.Labels[parts[0]]
+		return exists && (len(parts) == 1 || value == parts[1])
+	case "network":
+		if container.NetworkSettings != nil {
+			if _, exists := container.NetworkSettings.Networks[r.value]; exists {
+				return true
+			}
+		}
+		if container.HostConfig == nil {
+			return false
+		}
+		mode := container.HostConfig.NetworkMode
+		// docker reports the bridge network as default
+		return mode == r.value || (mode == "default" && r.value == "bridge")
+	}
+	return false
+}
+
+func (r *filterRule) String() string {
+	return r.kind + ":" + r.value
+}
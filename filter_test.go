@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crosbymichael/skydock/docker"
+)
+
+func TestContainerFilter(t *testing.T) {
+	f, err := newContainerFilter("image:crosbymichael/*,label:skydock.enable", "name:^build-,label:env=test,network:host")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newContainer := func(image, name string, labels map[string]string, network string) *docker.Container {
+		return &docker.Container{
+			Image:      image,
+			Name:       name,
+			Config:     &docker.ContainerConfig{Labels: labels},
+			HostConfig: &docker.HostConfig{NetworkMode: network},
+		}
+	}
+
+	for _, test := range []struct {
+		container *docker.Container
+		expected  bool
+	}{
+		{newContainer("crosbymichael/redis:latest", "/redis1", nil, "default"), true},
+		{newContainer("ubuntu:14.04", "/shell", nil, "default"), false},
+		{newContainer("ubuntu:14.04", "/web", map[string]string{"skydock.enable": ""}, "default"), true},
+		{newContainer("crosbymichael/redis:latest", "/build-42", nil, "default"), false},
+		{newContainer("crosbymichael/redis:latest", "/redis2", map[string]string{"env": "test"}, "default"), false},
+		{newContainer("crosbymichael/redis:latest", "/redis3", map[string]string{"env": "prod"}, "default"), true},
+		{newContainer("crosbymichael/redis:latest", "/redis4", nil, "host"), false},
+	} {
+		if allowed, reason := f.allow(test.container); allowed != test.expected {
+			t.Fatalf("Expected %s to be allowed %v got %v (%s)", test.container.Name, test.expected, allowed, reason)
+		}
+	}
+}
+
+func TestContainerFilterImageBasename(t *testing.T) {
+	f, err := newContainerFilter("", "image:*-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for image, expected := range map[string]bool{
+		"org/app-builder:latest":             false,
+		"registry:5000/org/app-builder:1.0":  false,
+		"app-builder":                        false,
+		"org/app:latest":                     true,
+		"org/app-builder-cache/redis:latest": true,
+	} {
+		if allowed, _ := f.allow(&docker.Container{Image: image}); allowed != expected {
+			t.Fatalf("Expected %s to be allowed %v got %v", image, expected, allowed)
+		}
+	}
+}
+
+func TestContainerFilterNetwork(t *testing.T) {
+	f, err := newContainerFilter("network:bridge", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if allowed, _ := f.allow(&docker.Container{HostConfig: &docker.HostConfig{NetworkMode: "default"}}); !allowed {
+		t.Fatal("Expected the default network to match bridge")
+	}
+	connected := &docker.Container{
+		HostConfig: &docker.HostConfig{NetworkMode: "frontend"},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]*docker.EndpointSettings{"frontend": {}, "bridge": {}},
+		},
+	}
+	if allowed, _ := f.allow(connected); !allowed {
+		t.Fatal("Expected a container connected to bridge to match")
+	}
+	if allowed, _ := f.allow(&docker.Container{}); allowed {
+		t.Fatal("Expected a container without host config not to match")
+	}
+}
+
+func TestParseFilterRulesErrors(t *testing.T) {
+	for _, rules := range []string{"redis", "image:", "name:(", "image:[", "port:80"} {
+		if _, err := parseFilterRules(rules); err == nil {
+			t.Fatalf("Expected error for %q", rules)
+		}
+	}
+}
+
+func TestShouldRegisterPlugin(t *testing.T) {
+	p := newTestRuntime(t, `
+function shouldRegister(container) {
+    return container.Name !== "/tool";
+}
+
+function createService(container) {
+    return {Port: 80, Environment: defaultEnvironment, TTL: defaultTTL, Service: "app", Instance: "1", Host: "10.0.0.1"};
+}
+`)
+	plugins = p
+
+	skydns = &mockSkydns{make(map[string]*Service)}
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {Id: "1", Name: "/app", NetworkSettings: &docker.NetworkSettings{}},
+			"2": {Id: "2", Name: "/tool", NetworkSettings: &docker.NetworkSettings{}},
+		},
+	}
+
+	if err := addService("1", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addService("2", "tool"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isRegistered("1") {
+		t.Fatal("Expected container 1 to be registered")
+	}
+	if isRegistered("2") {
+		t.Fatal("Expected container 2 not to be registered")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/crosbymichael/log"
+	"github.com/skynetservices/skydns1/client"
+)
+
+const (
+	// errorBudget is the number of heartbeats in a row that can fail before
+	// skydock stops the heartbeat and leaves the container to the reconciler
+	errorBudget = 10
+
+	// heartbeatWorkers is the number of heartbeats sent at the same time so
+	// a slow backend does not hold up the others
+	heartbeatWorkers = 8
+)
+
+// scheduler refreshes the ttl of every registered service from a single loop.
+// Heartbeats are kept in a timer wheel with a slot for every tick that the
+// loop advances through, heartbeats further away than a full turn of the
+// wheel wait for the number of rounds left.  The due heartbeats are sent by
+// a pool of workers.
+type scheduler struct {
+	sync.Mutex
+
+	tick     time.Duration
+	position int
+	slots    []map[string]*heartbeat
+	beats    map[string]*heartbeat
+}
+
+type heartbeat struct {
+	uuid     string
+	ttl      uint32
+	slot     int
+	rounds   int
+	failures int
+	due      time.Time
+	last     time.Time
+}
+
+func newScheduler(tick time.Duration, size int) *scheduler {
+	s := &scheduler{
+		tick:  tick,
+		slots: make([]map[string]*heartbeat, size),
+		beats: make(map[string]*heartbeat),
+	}
+	for i := range s.slots {
+		s.slots[i] = make(map[string]*heartbeat)
+	}
+	return s
+}
+
+// add starts the heartbeat for the service with the given ttl if it is
+// not running, otherwise the running heartbeat sends the new ttl
+func (s *scheduler) add(uuid string, ttl uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	if h, exists := s.beats[uuid]; exists {
+		h.ttl = ttl
+		return
+	}
+	h := &heartbeat{uuid: uuid, ttl: ttl, last: time.Now()}
+	s.beats[uuid] = h
+	s.schedule(h, jitter(s.interval(h)))
+}
+
+// remove stops the heartbeat for the service
+func (s *scheduler) remove(uuid string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if h, exists := s.beats[uuid]; exists {
+		delete(s.slots[h.slot], uuid)
+		delete(s.beats, uuid)
+	}
+}
+
+// lastBeat returns the time of the last successful heartbeat of the service
+func (s *scheduler) lastBeat(uuid string) time.Time {
+	s.Lock()
+	defer s.Unlock()
+
+	if h, exists := s.beats[uuid]; exists {
+		return h.last
+	}
+	return time.Time{}
+}
+
+// run advances the wheel every tick until stop is closed
+func (s *scheduler) run(stop <-chan struct{}) {
+	defer background.Done()
+
+	var (
+		workers sync.WaitGroup
+		due     = make(chan *heartbeat)
+	)
+	for i := 0; i < heartbeatWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for h := range due {
+				s.beat(h)
+			}
+		}()
+	}
+	defer workers.Wait()
+	defer close(due)
+
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+
+	next := time.Now().Add(s.tick)
+	for {
+		var now time.Time
+		select {
+		case <-stop:
+			return
+		case now = <-ticker.C:
+		}
+
+		// the ticker drops ticks while all the workers are busy so
+		// advance the wheel by the ticks that have passed since
+		for ; !now.Before(next); next = next.Add(s.tick) {
+			for _, h := range s.advance() {
+				select {
+				case due <- h:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}
+}
+
+// advance moves the wheel to the next slot and returns the heartbeats due
+func (s *scheduler) advance() []*heartbeat {
+	s.Lock()
+	defer s.Unlock()
+
+	s.position = (s.position + 1) % len(s.slots)
+
+	var due []*heartbeat
+	for uuid, h := range s.slots[s.position] {
+		if h.rounds > 0 {
+			h.rounds--
+			continue
+		}
+		delete(s.slots[s.position], uuid)
+		due = append(due, h)
+	}
+	return due
+}
+
+// beat refreshes the ttl of the service.  Failures are retried with an
+// exponential backoff until the error budget is used up.
+func (s *scheduler) beat(h *heartbeat) {
+	heartbeatLag.observe(time.Since(h.due))
+
+	s.Lock()
+	ttl, interval := h.ttl, s.interval(h)
+	s.Unlock()
+
+	// don't fill logs if we have a low beat
+	// may need to do something better here
+	if interval >= 30*time.Second {
+		log.Logf(log.INFO, "updating ttl for %s", h.uuid)
+	}
+
+	err := updateService(h.uuid, int(ttl))
+	if err == client.ErrServiceNotFound {
+		// the service expired or skydns lost it so add it again
+		if service := findService(h.uuid); service != nil {
+			log.Logf(log.INFO, "service %s not found, adding it again", h.uuid)
+			err = skydns.Add(h.uuid, service)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.beats[h.uuid] != h {
+		// removed while we were updating it
+		return
+	}
+
+	if err == nil {
+		h.failures = 0
+		h.last = time.Now()
+		s.schedule(h, jitter(s.interval(h)))
+		return
+	}
+
+	h.failures++
+	log.Logf(log.ERROR, "heartbeat for %s failed (%d/%d): %s", h.uuid, h.failures, errorBudget, err)
+
+	if h.failures >= errorBudget {
+		log.Logf(log.ERROR, "aborting heartbeat for %s after %d errors", h.uuid, h.failures)
+		delete(s.beats, h.uuid)
+
+		// the service will expire so let the reconciler add the container again
+		forgetContainer(h.uuid)
+		return
+	}
+	s.schedule(h, backoff(h.failures, s.interval(h)))
+}
+
+// schedule places the heartbeat in the slot that the wheel reaches after the delay
+func (s *scheduler) schedule(h *heartbeat, delay time.Duration) {
+	ticks := int(delay / s.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	h.slot = (s.position + ticks) % len(s.slots)
+	h.rounds = (ticks - 1) / len(s.slots)
+	h.due = time.Now().Add(delay)
+	s.slots[h.slot][h.uuid] = h
+}
+
+// interval returns the time between the heartbeats of the service.  Services
+// with the default ttl use the -beat interval, the ones with their own ttl
+// are refreshed after three quarters of it so they do not expire in between.
+func (s *scheduler) interval(h *heartbeat) time.Duration {
+	if h.ttl == 0 || int(h.ttl) == ttl {
+		return time.Duration(beat) * time.Second
+	}
+	return time.Duration(h.ttl-h.ttl/4) * time.Second
+}
+
+// jitter spreads the heartbeats of services registered at the
+// same time by moving them up to a tenth of the interval earlier
+func jitter(interval time.Duration) time.Duration {
+	if spread := int64(interval / 10); spread > 0 {
+		return interval - time.Duration(rand.Int63n(spread))
+	}
+	return interval
+}
+
+// backoff returns the delay before retrying a heartbeat that failed,
+// doubling from a second for every failure up to the interval
+func backoff(failures int, interval time.Duration) time.Duration {
+	delay := time.Second << uint(failures-1)
+	if delay > interval || delay <= 0 {
+		return interval
+	}
+	return delay
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns1/msg"
+)
+
+func TestSchedulerWheel(t *testing.T) {
+	s := newScheduler(time.Second, 4)
+
+	h := &heartbeat{uuid: "1"}
+	s.beats["1"] = h
+	s.schedule(h, 6*time.Second)
+
+	for i := 1; i < 6; i++ {
+		if due := s.advance(); len(due) != 0 {
+			t.Fatalf("Expected no heartbeats due after %d ticks got %d", i, len(due))
+		}
+	}
+
+	due := s.advance()
+	if len(due) != 1 || due[0] != h {
+		t.Fatalf("Expected heartbeat for 1 to be due after 6 ticks got %v", due)
+	}
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	beat = 3
+	s := newScheduler(time.Second, 4)
+
+	s.add("1", uint32(ttl))
+	s.remove("1")
+
+	for i := 0; i < 8; i++ {
+		if due := s.advance(); len(due) != 0 {
+			t.Fatalf("Expected no heartbeats due for removed service got %d", len(due))
+		}
+	}
+}
+
+func TestHeartbeatAddsMissingService(t *testing.T) {
+	beat = 3
+	skydns = &mockSkydns{make(map[string]*Service)}
+	registered = make(map[string][]*Service)
+
+	service := &Service{Service: msg.Service{UUID: "1", Name: "redis", TTL: 30}}
+	registerService("1", service)
+
+	s := newScheduler(time.Second, 4)
+	s.add("1", uint32(ttl))
+	s.beat(s.beats["1"])
+
+	if skydns.(*mockSkydns).services["1"] != service {
+		t.Fatal("Expected service 1 to be added again")
+	}
+	if h := s.beats["1"]; h == nil || h.failures != 0 {
+		t.Fatalf("Expected heartbeat for 1 to continue without failures got %v", h)
+	}
+}
+
+func TestHeartbeatErrorBudget(t *testing.T) {
+	beat = 3
+	skydns = &failingSkydns{mockSkydns{make(map[string]*Service)}, errorBudget}
+	registered = make(map[string][]*Service)
+
+	// the container's other service keeps it registered unless the whole container is forgotten
+	registerService("1", &Service{Service: msg.Service{UUID: "1-6379-tcp", Name: "redis", TTL: 30}})
+	registerService("1", &Service{Service: msg.Service{UUID: "1-6380-tcp", Name: "redis", TTL: 30}})
+
+	s := newScheduler(time.Second, 4)
+	s.add("1-6379-tcp", uint32(ttl))
+	h := s.beats["1-6379-tcp"]
+
+	for i := 1; i < errorBudget; i++ {
+		s.beat(h)
+		if h.failures != i {
+			t.Fatalf("Expected %d failures got %d", i, h.failures)
+		}
+		if h.rounds != 0 || h.slot != (s.position+int(backoff(i, s.interval(h))/time.Second))%len(s.slots) {
+			t.Fatalf("Expected failed heartbeat to be retried with a backoff")
+		}
+	}
+
+	s.beat(h)
+	if _, exists := s.beats["1-6379-tcp"]; exists {
+		t.Fatal("Expected heartbeat to stop after using the error budget")
+	}
+	if isRegistered("1") {
+		t.Fatal("Expected container to be left to the reconciler")
+	}
+}
+
+func TestHeartbeatServiceTTL(t *testing.T) {
+	defer func(v, b int) { ttl, beat = v, b }(ttl, beat)
+	ttl, beat = 60, 45
+
+	backend := &mockSkydns{make(map[string]*Service)}
+	backend.services["1"] = &Service{Service: msg.Service{UUID: "1", Name: "redis", TTL: 8}}
+	skydns = backend
+
+	// a service with a ttl below the beat is refreshed before it expires
+	s := newScheduler(time.Second, 60)
+	s.add("1", 8)
+	h := s.beats["1"]
+	if d := s.interval(h); d != 6*time.Second {
+		t.Fatalf("Expected a heartbeat every 6s for a ttl of 8 got %s", d)
+	}
+	if h.slot > 6 {
+		t.Fatalf("Expected the heartbeat for 1 to be due within its ttl got slot %d", h.slot)
+	}
+
+	s.beat(h)
+	if service := backend.services["1"]; service.TTL != 8 {
+		t.Fatalf("Expected the heartbeat to keep the ttl of 8 got %d", service.TTL)
+	}
+}
+
+// slowSkydns blocks updates of the slow service until released
+type slowSkydns struct {
+	mockSkydns
+	slow    string
+	release chan struct{}
+	updates chan string
+}
+
+func (s *slowSkydns) Update(uuid string, ttl uint32) error {
+	if uuid == s.slow {
+		<-s.release
+	}
+	s.updates <- uuid
+	return nil
+}
+
+func TestHeartbeatSlowBackend(t *testing.T) {
+	defer func(v int) { beat = v }(beat)
+	beat = 1
+
+	backend := &slowSkydns{
+		mockSkydns: mockSkydns{make(map[string]*Service)},
+		slow:       "slow",
+		release:    make(chan struct{}),
+		updates:    make(chan string, 100),
+	}
+	skydns = backend
+
+	s := newScheduler(10*time.Millisecond, 20)
+	s.add("slow", uint32(ttl))
+	s.add("fast", uint32(ttl))
+
+	stop := make(chan struct{})
+	background.Add(1)
+	go s.run(stop)
+	defer func() {
+		close(backend.release)
+		close(stop)
+		background.Wait()
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for fast := 0; fast < 2; {
+		select {
+		case uuid := <-backend.updates:
+			if uuid == "fast" {
+				fast++
+			}
+		case <-timeout:
+			t.Fatal("Expected heartbeats to continue while the backend is slow for another service")
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	interval := 45 * time.Second
+	for failures, expected := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		5:  16 * time.Second,
+		6:  32 * time.Second,
+		7:  interval,
+		80: interval,
+	} {
+		if d := backoff(failures, interval); d != expected {
+			t.Fatalf("Expected backoff %s after %d failures got %s", expected, failures, d)
+		}
+	}
+}
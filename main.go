@@ -1,15 +1,17 @@
-/*
-   Multihost
-   Multiple ports
-*/
-
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/crosbymichael/log"
@@ -17,59 +19,191 @@ import (
 	"github.com/crosbymichael/skydock/utils"
 	influxdb "github.com/influxdb/influxdb/client"
 	"github.com/skynetservices/skydns1/client"
-	"github.com/skynetservices/skydns1/msg"
 )
 
 var (
 	pathToSocket        string
+	dockerTLS           bool
+	dockerTLSVerify     bool
+	dockerTLSCACert     string
+	dockerTLSCert       string
+	dockerTLSKey        string
 	domain              string
 	environment         string
+	region              string
+	hostIp              string
 	skydnsUrl           string
 	skydnsContainerName string
+	backend             string
+	dnsAddr             string
+	nameservers         string
+	etcdUrl             string
+	etcdPrefix          string
+	hostsFile           string
+	zoneFile            string
+	consulUrl           string
+	consulToken         string
+	rfc2136Server       string
 	secret              string
 	ttl                 int
 	beat                int
 	numberOfHandlers    int
+	reconcileInterval   int
 	pluginFile          string
+	deregister          bool
+	stopTimeout         int
+	adminAddr           string
+	configFile          string
+	pluginFallback      bool
+	pluginTimeout       int
+	pluginWatch         int
+	networks            string
+	ipVersion           string
+	include             string
+	untagged            bool
+	exclude             string
 
 	skydns       Skydns
 	dockerClient docker.Docker
 	plugins      *pluginRuntime
-	running      = make(map[string]struct{})
-	runningLock  = sync.Mutex{}
+
+	// heartbeats refreshes the ttl of the registered services
+	heartbeats = newScheduler(time.Second, 60)
+
+	// filters decides which containers are registered
+	filters = &containerFilter{}
+
+	// quit is closed to stop the workers, heartbeats and reconciler on shutdown
+	quit       = make(chan struct{})
+	background = &sync.WaitGroup{}
+
+	// registered holds the services that skydock has added to skydns
+	// keyed by the container's uuid
+	registered     = make(map[string][]*Service)
+	registeredLock = sync.Mutex{}
 )
 
 func init() {
-	flag.StringVar(&pathToSocket, "s", "/var/run/docker.sock", "path to the docker unix socket")
+	dockerHost := "/var/run/docker.sock"
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		dockerHost = host
+	}
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	flag.StringVar(&pathToSocket, "s", dockerHost, "path to the docker unix socket or tcp://host:port, defaults to DOCKER_HOST")
+	flag.BoolVar(&dockerTLS, "tls", false, "use tls to connect to docker")
+	flag.BoolVar(&dockerTLSVerify, "tlsverify", os.Getenv("DOCKER_TLS_VERIFY") != "", "use tls to connect to docker and verify its certificate, defaults to DOCKER_TLS_VERIFY")
+	flag.StringVar(&dockerTLSCACert, "tlscacert", filepath.Join(certPath, "ca.pem"), "ca certificate to verify docker's certificate, defaults to DOCKER_CERT_PATH/ca.pem")
+	flag.StringVar(&dockerTLSCert, "tlscert", filepath.Join(certPath, "cert.pem"), "client certificate for docker, defaults to DOCKER_CERT_PATH/cert.pem")
+	flag.StringVar(&dockerTLSKey, "tlskey", filepath.Join(certPath, "key.pem"), "client key for docker, defaults to DOCKER_CERT_PATH/key.pem")
 	flag.StringVar(&skydnsUrl, "skydns", "", "url to the skydns url")
 	flag.StringVar(&skydnsContainerName, "name", "", "name of skydns container")
-	flag.StringVar(&secret, "secret", "", "skydns secret")
+	flag.StringVar(&backend, "backend", "skydns", "comma separated backends to register services with: skydns, dns for the built-in nameserver, etcd, hosts, zone, consul or rfc2136")
+	flag.StringVar(&dnsAddr, "dns", ":53", "address for the built-in nameserver to listen on")
+	flag.StringVar(&nameservers, "nameserver", "8.8.8.8:53", "comma separated nameservers the built-in nameserver forwards other queries to")
+	flag.StringVar(&etcdUrl, "etcd", "http://127.0.0.1:2379", "url of etcd for the etcd backend")
+	flag.StringVar(&etcdPrefix, "etcd-prefix", "/skydns", "path in etcd that skydns or coredns reads records from")
+	flag.StringVar(&hostsFile, "hosts-file", "/etc/skydock/hosts", "hosts file written by the hosts backend")
+	flag.StringVar(&zoneFile, "zone-file", "/etc/skydock/zone", "zone file written by the zone backend")
+	flag.StringVar(&consulUrl, "consul", "http://127.0.0.1:8500", "url of the consul agent for the consul backend")
+	flag.StringVar(&consulToken, "consul-token", "", "acl token for the consul agent")
+	flag.StringVar(&rfc2136Server, "rfc2136", "127.0.0.1:53", "primary nameserver that the rfc2136 backend sends updates to")
+	flag.StringVar(&secret, "secret", "", "skydns secret or tsig key, [algorithm:]name:secret, for the rfc2136 backend")
 	flag.StringVar(&domain, "domain", "", "same domain passed to skydns")
 	flag.StringVar(&environment, "environment", "dev", "environment name where service is running")
+	flag.StringVar(&region, "region", "", "region or name of the docker host, enables multihost mode")
+	flag.StringVar(&hostIp, "host", "", "ip of the docker host to register for published ports in multihost mode")
 	flag.IntVar(&ttl, "ttl", 60, "default ttl to use when registering a service")
 	flag.IntVar(&beat, "beat", 0, "heartbeat interval")
 	flag.IntVar(&numberOfHandlers, "workers", 3, "number of concurrent workers")
+	flag.IntVar(&reconcileInterval, "reconcile", 60, "interval in seconds to reconcile docker with skydns, 0 to disable")
 	flag.StringVar(&pluginFile, "plugins", "/plugins/default.js", "file containing javascript plugins (plugins.js)")
+	flag.BoolVar(&pluginFallback, "plugin-fallback", false, "register containers with the built-in mapping when the plugins fail")
+	flag.IntVar(&pluginWatch, "plugin-watch", 5, "interval in seconds to check the plugin file for changes, 0 to only reload on SIGHUP")
+	flag.IntVar(&pluginTimeout, "plugin-timeout", 1000, "milliseconds a plugin may run for a container before it is interrupted, 0 to disable")
+	flag.BoolVar(&deregister, "deregister", true, "remove all registered services from skydns on shutdown")
+	flag.IntVar(&stopTimeout, "stop-timeout", 10, "seconds to wait for requests to skydns to finish on shutdown")
+	flag.StringVar(&adminAddr, "admin", "", "address for the admin api to listen on, disabled if empty")
+	flag.StringVar(&ipVersion, "ip", "both", "addresses to register, v4, v6 or both")
+	flag.StringVar(&networks, "networks", "", "comma separated docker networks to register containers on, all networks if empty")
+	flag.BoolVar(&untagged, "untagged", false, "register containers started from an image id or digest using the image's repository name")
+	flag.StringVar(&include, "include", "", "comma separated rules for containers to register, image:<glob>, name:<regexp>, label:<key>[=<value>] or network:<name>")
+	flag.StringVar(&exclude, "exclude", "", "comma separated rules for containers not to register, same format as -include")
+	flag.StringVar(&configFile, "config", "", "yaml config file, settings can also be set with SKYDOCK_ environment variables")
 
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		settingSources[f.Name] = "-" + f.Name
+	})
 }
 
-func validateSettings() {
+// validateSettings checks the settings and fills in the ones derived from
+// others.  Errors name the flag, config key or environment variable to fix.
+func validateSettings() error {
+	if ttl < 1 {
+		return fmt.Errorf("%s: ttl must be greater than 0", settingName("ttl"))
+	}
 	if beat < 1 {
 		beat = ttl - (ttl / 4)
 	}
+	if numberOfHandlers < 1 {
+		return fmt.Errorf("%s: at least 1 worker is required", settingName("workers"))
+	}
+	if reconcileInterval < 0 {
+		return fmt.Errorf("%s: must not be negative", settingName("reconcile"))
+	}
+	if stopTimeout < 0 {
+		return fmt.Errorf("%s: must not be negative", settingName("stop-timeout"))
+	}
+	if pluginWatch < 0 {
+		return fmt.Errorf("%s: must not be negative", settingName("plugin-watch"))
+	}
+	if pluginTimeout < 0 {
+		return fmt.Errorf("%s: must not be negative", settingName("plugin-timeout"))
+	}
 
-	if (skydnsUrl != "") && (skydnsContainerName != "") {
-		fatal(fmt.Errorf("specify 'name' or 'skydns', not both"))
+	if _, err := parseFilterRules(include); err != nil {
+		return fmt.Errorf("%s: %s", settingName("include"), err)
+	}
+	if _, err := parseFilterRules(exclude); err != nil {
+		return fmt.Errorf("%s: %s", settingName("exclude"), err)
 	}
 
-	if (skydnsUrl == "") && (skydnsContainerName == "") {
-		skydnsUrl = "http://" + os.Getenv("SKYDNS_PORT_8080_TCP_ADDR") + ":8080"
+	backends := strings.Split(backend, ",")
+	for _, name := range backends {
+		if !containsString(backendNames, name) {
+			return fmt.Errorf("%s: unknown backend '%s'", settingName("backend"), name)
+		}
+	}
+
+	if containsString(backends, "skydns") {
+		if (skydnsUrl != "") && (skydnsContainerName != "") {
+			return fmt.Errorf("%s, %s: specify 'name' or 'skydns', not both", settingName("name"), settingName("skydns"))
+		}
+
+		if (skydnsUrl == "") && (skydnsContainerName == "") {
+			skydnsUrl = "http://" + os.Getenv("SKYDNS_PORT_8080_TCP_ADDR") + ":8080"
+		}
 	}
 
 	if domain == "" {
-		fatal(fmt.Errorf("Must specify your skydns domain"))
+		return fmt.Errorf("%s: Must specify your skydns domain", settingName("domain"))
+	}
+
+	if (region != "") && (hostIp == "") {
+		return fmt.Errorf("%s: Must specify the 'host' ip in multihost mode", settingName("host"))
+	}
+	if !containsString([]string{"v4", "v6", "both"}, ipVersion) {
+		return fmt.Errorf("%s: must be v4, v6 or both", settingName("ip"))
+	}
+
+	if (hostIp != "") && (net.ParseIP(hostIp) == nil) {
+		return fmt.Errorf("%s: invalid ip '%s'", settingName("host"), hostIp)
 	}
+	return nil
 }
 
 func setupLogger() error {
@@ -100,76 +234,167 @@ func setupLogger() error {
 	return nil
 }
 
-func heartbeat(uuid string) {
-	runningLock.Lock()
-	if _, exists := running[uuid]; exists {
-		runningLock.Unlock()
-		return
+// reconcile diffs the running containers against the services that
+// skydock has registered, adding the missing ones to skydns and removing
+// the ones for containers that no longer run
+func reconcile() error {
+	containers, err := dockerClient.FetchAllContainers()
+	if err != nil {
+		return err
 	}
-	running[uuid] = struct{}{}
-	runningLock.Unlock()
 
-	defer func() {
-		runningLock.Lock()
-		delete(running, uuid)
-		runningLock.Unlock()
-	}()
+	var (
+		added, removed int
+		current        = make(map[string]*docker.Container, len(containers))
+	)
+	for _, cnt := range containers {
+		current[utils.Truncate(cnt.Id)] = cnt
+	}
 
-	var errorCount int
-	for _ = range time.Tick(time.Duration(beat) * time.Second) {
-		if errorCount > 10 {
-			// if we encountered more than 10 errors just quit
-			log.Logf(log.ERROR, "aborting heartbeat for %s after 10 errors", uuid)
-			return
+	for uuid, cnt := range current {
+		if isRegistered(uuid) {
+			continue
+		}
+		if err := addService(uuid, cnt.Image); err != nil {
+			log.Logf(log.ERROR, "failed to add %s to skydns on reconcile: %s", uuid, err)
+			continue
 		}
+		if isRegistered(uuid) {
+			added++
+		}
+	}
 
-		// don't fill logs if we have a low beat
-		// may need to do something better here
-		if beat >= 30 {
-			log.Logf(log.INFO, "updating ttl for %s", uuid)
+	for _, uuid := range registeredServices() {
+		if _, exists := current[uuid]; exists {
+			continue
+		}
+		if err := removeService(uuid); err != nil {
+			log.Logf(log.ERROR, "failed to remove %s from skydns on reconcile: %s", uuid, err)
+			continue
 		}
+		removed++
+	}
+
+	log.Logf(log.INFO, "reconciled %d containers: %d added, %d removed", len(current), added, removed)
+	return nil
+}
+
+// reconcileLoop runs reconcile at the given interval until skydock stops
+func reconcileLoop(interval time.Duration) {
+	defer background.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		if err := updateService(uuid, ttl); err != nil {
-			errorCount++
-			log.Logf(log.ERROR, "%s", err)
-			break
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := reconcile(); err != nil {
+			log.Logf(log.ERROR, "error reconciling containers: %s", err)
 		}
 	}
 }
 
-// restoreContainers loads all running containers and inserts
-// them into skydns when skydock starts
-func restoreContainers() error {
-	containers, err := dockerClient.FetchAllContainers()
-	if err != nil {
-		return err
+func isRegistered(uuid string) bool {
+	registeredLock.Lock()
+	_, exists := registered[uuid]
+	registeredLock.Unlock()
+	return exists
+}
+
+// registeredServices returns the uuids of all the containers skydock has
+// registered services for
+func registeredServices() []string {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	out := make([]string, 0, len(registered))
+	for uuid := range registered {
+		out = append(out, uuid)
 	}
+	return out
+}
 
-	var container *docker.Container
-	for _, cnt := range containers {
-		uuid := utils.Truncate(cnt.Id)
-		if container, err = dockerClient.FetchContainer(uuid, cnt.Image); err != nil {
-			if err != docker.ErrImageNotTagged {
-				log.Logf(log.ERROR, "failed to fetch %s on restore: %s", cnt.Id, err)
+// containerServices returns the services registered for the container
+func containerServices(uuid string) []*Service {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	return append([]*Service(nil), registered[uuid]...)
+}
+
+// findService returns the registered service with the given skydns uuid
+func findService(uuid string) *Service {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	for _, services := range registered {
+		for _, s := range services {
+			if s.UUID == uuid {
+				return s
 			}
-			continue
 		}
+	}
+	return nil
+}
 
-		service, err := plugins.createService(container)
-		if err != nil {
-			// doing a fatal here because we cannot do much if the plugins
-			// return an invalid service or error
-			fatal(err)
+func registerService(uuid string, service *Service) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	services := registered[uuid]
+	for i, s := range services {
+		if s.UUID == service.UUID {
+			services[i] = service
+			return
 		}
-		if err := sendService(uuid, service); err != nil {
-			log.Logf(log.ERROR, "failed to send %s to skydns on restore: %s", uuid, err)
+	}
+	registered[uuid] = append(services, service)
+}
+
+// forgetService removes the service with the given skydns uuid from
+// the registered services
+func forgetService(uuid string) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	for container, services := range registered {
+		for i, s := range services {
+			if s.UUID != uuid {
+				continue
+			}
+			if services = append(services[:i], services[i+1:]...); len(services) == 0 {
+				delete(registered, container)
+			} else {
+				registered[container] = services
+			}
+			return
+		}
+	}
+}
+
+// forgetContainer removes all the services of the container that has the
+// service with the given skydns uuid so that the reconciler adds them again
+func forgetContainer(uuid string) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	for container, services := range registered {
+		for _, s := range services {
+			if s.UUID == uuid {
+				delete(registered, container)
+				return
+			}
 		}
 	}
-	return nil
 }
 
 // sendService sends the uuid and service data to skydns
-func sendService(uuid string, service *msg.Service) error {
+func sendService(uuid string, service *Service) error {
 	log.Logf(log.INFO, "adding %s (%s) to skydns", uuid, service.Name)
 	if err := skydns.Add(uuid, service); err != nil {
 		// ignore erros for conflicting uuids and start the heartbeat again
@@ -177,15 +402,32 @@ func sendService(uuid string, service *msg.Service) error {
 			return err
 		}
 		log.Logf(log.INFO, "service already exists for %s. Resetting ttl.", uuid)
-		updateService(uuid, ttl)
+		updateService(uuid, int(service.TTL))
 	}
-	go heartbeat(uuid)
+
+	heartbeats.add(uuid, service.TTL)
 	return nil
 }
 
+// removeService removes all the services of the container from skydns
 func removeService(uuid string) error {
-	log.Logf(log.INFO, "removing %s from skydns", uuid)
-	return skydns.Delete(uuid)
+	services := containerServices(uuid)
+	if len(services) == 0 {
+		// not registered by us but it may still be in skydns
+		service := &Service{}
+		service.UUID = serviceUUID(uuid, service)
+		services = []*Service{service}
+	}
+
+	for _, service := range services {
+		log.Logf(log.INFO, "removing %s from skydns", service.UUID)
+		if err := skydns.Delete(service.UUID); err != nil && err != client.ErrServiceNotFound {
+			return err
+		}
+		heartbeats.remove(service.UUID)
+		forgetService(service.UUID)
+	}
+	return nil
 }
 
 func addService(uuid, image string) error {
@@ -197,19 +439,73 @@ func addService(uuid, image string) error {
 		return nil
 	}
 
-	service, err := plugins.createService(container)
+	services, err := buildServices(uuid, container)
 	if err != nil {
-		// doing a fatal here because we cannot do much if the plugins
-		// return an invalid service or error
-		fatal(err)
-	}
-
-	if err := sendService(uuid, service); err != nil {
 		return err
 	}
+	for i, service := range services {
+		if err := sendService(service.UUID, service); err != nil {
+			// the container is only registered once all of its services are
+			// added so that the reconciler tries all of them again
+			for _, sent := range services[:i] {
+				if err := skydns.Delete(sent.UUID); err != nil && err != client.ErrServiceNotFound {
+					log.Logf(log.ERROR, "failed to remove %s from skydns: %s", sent.UUID, err)
+				}
+				heartbeats.remove(sent.UUID)
+			}
+			return err
+		}
+	}
+	for _, service := range services {
+		registerService(uuid, service)
+	}
 	return nil
 }
 
+// buildServices runs the plugins for the container and returns its services
+// with their skydns uuids set, none if the container is not registered
+func buildServices(uuid string, container *docker.Container) ([]*Service, error) {
+	if ok, reason := filters.allow(container); !ok {
+		log.Logf(log.DEBUG, "not adding %s: %s", uuid, reason)
+		return nil, nil
+	}
+	runtime := currentPlugins()
+	ok, err := runtime.shouldRegister(container)
+	if err != nil {
+		countPluginFailure("shouldRegister", err)
+		if !pluginFallback {
+			return nil, fmt.Errorf("shouldRegister plugin failed for %s: %s", uuid, err)
+		}
+		log.Logf(log.ERROR, "shouldRegister plugin failed for %s, adding it anyway: %s", uuid, err)
+		ok = true
+	}
+	if !ok {
+		log.Logf(log.DEBUG, "not adding %s: shouldRegister plugin returned false", uuid)
+		return nil, nil
+	}
+
+	start := time.Now()
+	services, err := runtime.createServices(container)
+	pluginDuration.observe(time.Since(start))
+	if err != nil {
+		countPluginFailure("createService", err)
+		if !pluginFallback {
+			return nil, fmt.Errorf("createService plugin failed for %s: %s", uuid, err)
+		}
+		log.Logf(log.ERROR, "createService plugin failed for %s, using the built-in mapping: %s", uuid, err)
+		services = defaultServices(container)
+	}
+
+	if len(services) == 0 {
+		log.Logf(log.DEBUG, "no services to add for %s", uuid)
+	}
+
+	for _, service := range services {
+		service.UUID = serviceUUID(uuid, service)
+	}
+	return services, nil
+}
+
 func updateService(uuid string, ttl int) error {
 	return skydns.Update(uuid, uint32(ttl))
 }
@@ -217,9 +513,21 @@ func updateService(uuid string, ttl int) error {
 func eventHandler(c chan *docker.Event, group *sync.WaitGroup) {
 	defer group.Done()
 
-	for event := range c {
+	for {
+		var event *docker.Event
+		select {
+		case <-quit:
+			return
+		case e, ok := <-c:
+			if !ok {
+				return
+			}
+			event = e
+		}
+
 		log.Logf(log.DEBUG, "received event (%s) %s %s", event.Status, event.ContainerId, event.Image)
 		uuid := utils.Truncate(event.ContainerId)
+		dockerEvents.inc(event.Status)
 
 		switch event.Status {
 		case "die", "stop", "kill":
@@ -230,7 +538,118 @@ func eventHandler(c chan *docker.Event, group *sync.WaitGroup) {
 			if err := addService(uuid, event.Image); err != nil {
 				log.Logf(log.ERROR, "error adding %s to skydns: %s", uuid, err)
 			}
+		case docker.StatusReconnect:
+			// events may have been missed while we were disconnected
+			if err := reconcile(); err != nil {
+				log.Logf(log.ERROR, "error reconciling containers after reconnect: %s", err)
+			}
+		}
+	}
+}
+
+// newBackends returns the Skydns implementation that registers services with
+// all the named backends
+func newBackends(names []string) (Skydns, error) {
+	if len(names) == 1 {
+		return newBackend(names[0])
+	}
+
+	backends := make([]Skydns, len(names))
+	for i, name := range names {
+		b, err := newBackend(name)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to %s: %s", name, err)
+		}
+		backends[i] = b
+	}
+	return newMultiBackend(names, backends), nil
+}
+
+// backendNames are the backends that newBackend knows
+var backendNames = []string{"skydns", "dns", "etcd", "hosts", "zone", "consul", "rfc2136"}
+
+// newBackend returns the Skydns implementation that registers services
+// with the named backend
+func newBackend(name string) (Skydns, error) {
+	switch name {
+	case "skydns":
+		if skydnsContainerName != "" {
+			container, err := dockerClient.FetchContainer(skydnsContainerName, "")
+			if err != nil {
+				return nil, fmt.Errorf("error retrieving skydns container '%s': %s", skydnsContainerName, err)
+			}
+
+			skydnsUrl = "http://" + container.NetworkSettings.Address() + ":8080"
+		}
+
+		log.Logf(log.INFO, "skydns URL: %s", skydnsUrl)
+
+		c, err := client.NewClient(skydnsUrl, secret, domain, "172.17.42.1:53")
+		if err != nil {
+			return nil, err
+		}
+		return &skydnsClient{Client: c}, nil
+	case "dns":
+		var forwarders []string
+		if nameservers != "" {
+			forwarders = strings.Split(nameservers, ",")
+		}
+
+		server := newDNSServer(domain, forwarders)
+		go func() {
+			log.Logf(log.INFO, "starting nameserver on %s", dnsAddr)
+			if err := server.ListenAndServe(dnsAddr); err != nil {
+				log.Logf(log.FATAL, "error starting nameserver: %s", err)
+				fatal(err)
+			}
+		}()
+		return server, nil
+	case "etcd":
+		log.Logf(log.INFO, "etcd URL: %s", etcdUrl)
+		return newEtcdClient(etcdUrl, etcdPrefix, domain), nil
+	case "hosts":
+		log.Logf(log.INFO, "writing hosts file %s", hostsFile)
+		return newHostsFile(hostsFile, domain)
+	case "zone":
+		log.Logf(log.INFO, "writing zone file %s", zoneFile)
+		return newZoneFile(zoneFile, domain)
+	case "consul":
+		log.Logf(log.INFO, "consul URL: %s", consulUrl)
+		return newConsulClient(consulUrl, consulToken), nil
+	case "rfc2136":
+		log.Logf(log.INFO, "sending dynamic updates to %s", rfc2136Server)
+		return newRFC2136Client(rfc2136Server, domain, secret)
+	}
+	return nil, fmt.Errorf("unknown backend '%s'", name)
+}
+
+// shutdown stops the workers, heartbeats and reconciler and waits for their
+// requests to skydns to finish before removing the services registered by this
+// instance.  It gives up waiting after the stop timeout.
+func shutdown(workers *sync.WaitGroup) {
+	close(quit)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		workers.Wait()
+		background.Wait()
+
+		if deregister {
+			for _, uuid := range registeredServices() {
+				if err := removeService(uuid); err != nil {
+					log.Logf(log.ERROR, "error removing %s from skydns on shutdown: %s", uuid, err)
+				}
+			}
 		}
+	}()
+
+	select {
+	case <-done:
+		log.Logf(log.INFO, "stopped cleanly")
+	case <-time.After(time.Duration(stopTimeout) * time.Second):
+		log.Logf(log.ERROR, "timed out after %ds waiting for requests to skydns to finish", stopTimeout)
 	}
 }
 
@@ -241,7 +660,12 @@ func fatal(err error) {
 }
 
 func main() {
-	validateSettings()
+	if err := loadConfig(configFile); err != nil {
+		fatal(err)
+	}
+	if err := validateSettings(); err != nil {
+		fatal(err)
+	}
 	if err := setupLogger(); err != nil {
 		fatal(err)
 	}
@@ -251,39 +675,64 @@ func main() {
 		group = &sync.WaitGroup{}
 	)
 
-	plugins, err = newRuntime(pluginFile)
-	if err != nil {
+	if filters, err = newContainerFilter(include, exclude); err != nil {
 		fatal(err)
 	}
 
-	if dockerClient, err = docker.NewClient(pathToSocket); err != nil {
-		log.Logf(log.FATAL, "error connecting to docker: %s", err)
+	// an interpreter for every worker and one shared by the reconciler, admin api and reloads
+	plugins, err = newRuntime(pluginFile, numberOfHandlers+1)
+	if err != nil {
 		fatal(err)
 	}
 
-	if skydnsContainerName != "" {
-		container, err := dockerClient.FetchContainer(skydnsContainerName, "")
-		if err != nil {
-			log.Logf(log.FATAL, "error retrieving skydns container '%s': %s", skydnsContainerName, err)
+	var tlsConfig *tls.Config
+	if dockerTLS || dockerTLSVerify {
+		if tlsConfig, err = docker.NewTLSConfig(dockerTLSCACert, dockerTLSCert, dockerTLSKey, dockerTLSVerify); err != nil {
+			log.Logf(log.FATAL, "error loading docker tls certificates: %s", err)
 			fatal(err)
 		}
-
-		skydnsUrl = "http://" + container.NetworkSettings.IpAddress + ":8080"
 	}
 
-	log.Logf(log.INFO, "skydns URL: %s", skydnsUrl)
+	if dockerClient, err = docker.NewClient(pathToSocket, tlsConfig, untagged); err != nil {
+		log.Logf(log.FATAL, "error connecting to docker: %s", err)
+		fatal(err)
+	}
 
-	if skydns, err = client.NewClient(skydnsUrl, secret, domain, "172.17.42.1:53"); err != nil {
-		log.Logf(log.FATAL, "error connecting to skydns: %s", err)
+	if skydns, err = newBackends(strings.Split(backend, ",")); err != nil {
+		log.Logf(log.FATAL, "error setting up backends: %s", err)
 		fatal(err)
 	}
+	skydns = &instrumentedBackend{skydns}
 
 	log.Logf(log.DEBUG, "starting restore of containers")
-	if err := restoreContainers(); err != nil {
+	if err := reconcile(); err != nil {
 		log.Logf(log.FATAL, "error restoring containers: %s", err)
 		fatal(err)
 	}
 
+	background.Add(1)
+	go heartbeats.run(quit)
+
+	if reconcileInterval > 0 {
+		background.Add(1)
+		go reconcileLoop(time.Duration(reconcileInterval) * time.Second)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	background.Add(1)
+	go watchPlugins(time.Duration(pluginWatch)*time.Second, hup)
+
+	if adminAddr != "" {
+		go func() {
+			log.Logf(log.INFO, "starting admin api on %s", adminAddr)
+			if err := http.ListenAndServe(adminAddr, newAdminHandler()); err != nil {
+				log.Logf(log.FATAL, "error starting admin api: %s", err)
+				fatal(err)
+			}
+		}()
+	}
+
 	events := dockerClient.GetEvents()
 
 	group.Add(numberOfHandlers)
@@ -292,7 +741,21 @@ func main() {
 		go eventHandler(events, group)
 	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
 	log.Logf(log.DEBUG, "starting main process")
-	group.Wait()
-	log.Logf(log.DEBUG, "stopping cleanly via EOF")
+	select {
+	case sig := <-signals:
+		log.Logf(log.INFO, "received signal '%v', stopping", sig)
+	case <-done:
+		log.Logf(log.DEBUG, "stopping cleanly via EOF")
+	}
+	shutdown(group)
 }
@@ -2,20 +2,23 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/crosbymichael/skydock/docker"
+	"github.com/robertkrimen/otto"
 	"github.com/skynetservices/skydns1/client"
 	"github.com/skynetservices/skydns1/msg"
 )
 
 type mockSkydns struct {
-	services map[string]*msg.Service
+	services map[string]*Service
 }
 
-func (s *mockSkydns) Add(uuid string, service *msg.Service) error {
+func (s *mockSkydns) Add(uuid string, service *Service) error {
 	if _, exists := s.services[uuid]; exists {
 		return client.ErrConflictingUUID
 	}
@@ -42,6 +45,42 @@ func (s *mockSkydns) Delete(uuid string) error {
 	return nil
 }
 
+// newTestRuntime returns a plugin runtime for the script
+func newTestRuntime(t *testing.T, script string) *pluginRuntime {
+	return newTestRuntimeWithGlobals(t, script, nil)
+}
+
+// newTestRuntimeWithGlobals returns a plugin runtime for the script whose
+// interpreters also have the globals, like Go functions that panic
+func newTestRuntimeWithGlobals(t *testing.T, script string, globals map[string]interface{}) *pluginRuntime {
+	f, err := ioutil.TempFile("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(script); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	p, err := loadRuntime(f.Name(), 1, func(o *otto.Otto) error {
+		if err := loadDefaults(o); err != nil {
+			return err
+		}
+		for name, value := range globals {
+			if err := o.Set(name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
 type mockDocker struct {
 	containers map[string]*docker.Container
 }
@@ -72,7 +111,7 @@ func TestCreateService(t *testing.T) {
 	environment = "production"
 	ttl = 30
 
-	p, err := newRuntime("plugins/default.js")
+	p, err := newRuntime("plugins/default.js", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -86,10 +125,11 @@ func TestCreateService(t *testing.T) {
 		},
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createServices(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 
 	if service.Version != "redis1" {
 		t.Fatalf("Expected version redis1 got %s", service.Version)
@@ -113,13 +153,13 @@ func TestCreateService(t *testing.T) {
 }
 
 func TestAddService(t *testing.T) {
-	p, err := newRuntime("plugins/default.js")
+	p, err := newRuntime("plugins/default.js", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	skydns = &mockSkydns{make(map[string]*Service)}
 	dockerClient = &mockDocker{
 		containers: map[string]*docker.Container{
 			"1": {
@@ -160,13 +200,13 @@ func TestAddService(t *testing.T) {
 }
 
 func TestRemoveService(t *testing.T) {
-	p, err := newRuntime("plugins/default.js")
+	p, err := newRuntime("plugins/default.js", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	skydns = &mockSkydns{make(map[string]*Service)}
 	dockerClient = &mockDocker{
 		containers: map[string]*docker.Container{
 			"1": {
@@ -206,13 +246,13 @@ func TestEventHandler(t *testing.T) {
 		group  = &sync.WaitGroup{}
 	)
 
-	p, err := newRuntime("plugins/default.js")
+	p, err := newRuntime("plugins/default.js", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	skydns = &mockSkydns{make(map[string]*Service)}
 	container := &docker.Container{
 		Image: "crosbymichael/redis:latest",
 		Name:  "redis1",
@@ -253,7 +293,7 @@ func TestEnvironmentPlugin(t *testing.T) {
 	environment = "production"
 	ttl = 30
 
-	p, err := newRuntime("plugins/containerEnv.js")
+	p, err := newRuntime("plugins/containerEnv.js", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -274,10 +314,11 @@ func TestEnvironmentPlugin(t *testing.T) {
 		},
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createServices(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 
 	if service.Version != "test1" {
 		t.Fatalf("Expected version test1 got %s", service.Version)
@@ -301,13 +342,13 @@ func TestEnvironmentPlugin(t *testing.T) {
 }
 
 func TestGetMappedPorts(t *testing.T) {
-	p, err := newRuntime("plugins/default.js")
+	p, err := newRuntime("plugins/default.js", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	skydns = &mockSkydns{make(map[string]*Service)}
 	container := &docker.Container{
 		Image: "crosbymichael/redis:latest",
 		Name:  "redis1",
@@ -320,23 +361,24 @@ func TestGetMappedPorts(t *testing.T) {
 		State: docker.State("running"),
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createServices(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 	if service.Port != 53 {
 		t.Fatalf("Expected port 53 got %d", service.Port)
 	}
 }
 
 func TestGetExposedPorts(t *testing.T) {
-	p, err := newRuntime("plugins/default.js")
+	p, err := newRuntime("plugins/default.js", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	skydns = &mockSkydns{make(map[string]*Service)}
 	container := &docker.Container{
 		Image: "crosbymichael/redis:latest",
 		Name:  "redis1",
@@ -349,11 +391,718 @@ func TestGetExposedPorts(t *testing.T) {
 		State: docker.State("running"),
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createServices(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 	if service.Port != 6379 {
 		t.Fatalf("Expected port 6379 got %d", service.Port)
 	}
 }
+
+func TestReconcile(t *testing.T) {
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	registered = make(map[string][]*Service)
+	skydns = &mockSkydns{make(map[string]*Service)}
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {
+				Id:    "1",
+				Image: "crosbymichael/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+				},
+			},
+		},
+	}
+
+	// a service for a container that is no longer running
+	stale := &Service{Service: msg.Service{UUID: "2", Name: "redis", Version: "redis2"}}
+	if err := sendService(stale.UUID, stale); err != nil {
+		t.Fatal(err)
+	}
+	registerService("2", stale)
+
+	if err := reconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	services := skydns.(*mockSkydns).services
+	if services["1"] == nil {
+		t.Fatal("Missing service not added on reconcile")
+	}
+	if services["2"] != nil {
+		t.Fatal("Stale service not removed on reconcile")
+	}
+
+	if !isRegistered("1") || isRegistered("2") {
+		t.Fatalf("Expected only 1 to be registered got %v", registeredServices())
+	}
+}
+
+// rejectingSkydns fails to add the service with the given uuid
+type rejectingSkydns struct {
+	mockSkydns
+	reject string
+}
+
+func (s *rejectingSkydns) Add(uuid string, service *Service) error {
+	if uuid == s.reject {
+		return fmt.Errorf("backend unavailable")
+	}
+	return s.mockSkydns.Add(uuid, service)
+}
+
+func TestReconcilePartialAdd(t *testing.T) {
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	backend := &rejectingSkydns{mockSkydns{make(map[string]*Service)}, "5-53-udp"}
+	skydns = backend
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"5": {
+				Id:    "5",
+				Image: "crosbymichael/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+					Ports: map[string][]docker.Binding{
+						"6379/tcp": nil,
+						"53/udp":   nil,
+					},
+				},
+			},
+		},
+	}
+
+	if err := addService("5", "crosbymichael/redis"); err == nil {
+		t.Fatal("Expected error adding 5")
+	}
+	if isRegistered("5") || len(backend.services) != 0 {
+		t.Fatalf("Expected 5 not to be registered got %v", backend.services)
+	}
+
+	backend.reject = ""
+	if err := reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if backend.services["5-6379-tcp"] == nil || backend.services["5-53-udp"] == nil {
+		t.Fatalf("Expected both ports of 5 to be added on reconcile got %v", backend.services)
+	}
+	if len(containerServices("5")) != 2 {
+		t.Fatalf("Expected 2 services registered for 5 got %d", len(containerServices("5")))
+	}
+}
+
+func TestCreateServicePerPort(t *testing.T) {
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	skydns = &mockSkydns{make(map[string]*Service)}
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"4": {
+				Image: "crosbymichael/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+					Ports: map[string][]docker.Binding{
+						"6379/tcp": {{HostIp: "0.0.0.0", HostPort: "49153"}},
+						"53/udp":   nil,
+					},
+				},
+			},
+		},
+	}
+
+	if err := addService("4", "crosbymichael/redis"); err != nil {
+		t.Fatal(err)
+	}
+
+	services := skydns.(*mockSkydns).services
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services got %d", len(services))
+	}
+
+	redis := services["4-6379-tcp"]
+	if redis == nil {
+		t.Fatal("No service added for 6379/tcp")
+	}
+	if redis.Port != 6379 || redis.Protocol != "tcp" {
+		t.Fatalf("Expected 6379/tcp got %d/%s", redis.Port, redis.Protocol)
+	}
+
+	dns := services["4-53-udp"]
+	if dns == nil {
+		t.Fatal("No service added for 53/udp")
+	}
+	if dns.Port != 53 || dns.Protocol != "udp" {
+		t.Fatalf("Expected 53/udp got %d/%s", dns.Port, dns.Protocol)
+	}
+
+	if err := removeService("4"); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 0 {
+		t.Fatalf("Expected all services removed got %d", len(services))
+	}
+}
+
+func TestMultihostPorts(t *testing.T) {
+	region, hostIp = "host1", "10.0.0.5"
+	defer func() {
+		region, hostIp = "", ""
+	}()
+
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	skydns = &mockSkydns{make(map[string]*Service)}
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"5": {
+				Image: "crosbymichael/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "172.17.0.2",
+					Ports: map[string][]docker.Binding{
+						"6379/tcp": {{HostIp: "0.0.0.0", HostPort: "49153"}},
+						"53/udp":   nil,
+					},
+				},
+			},
+		},
+	}
+
+	if err := addService("5", "crosbymichael/redis"); err != nil {
+		t.Fatal(err)
+	}
+
+	services := skydns.(*mockSkydns).services
+	if len(services) != 1 {
+		t.Fatalf("Expected only the published port to be added got %d services", len(services))
+	}
+
+	service := services["host1-5-6379-tcp"]
+	if service == nil {
+		t.Fatal("No service added for 6379/tcp")
+	}
+
+	if service.Host != "10.0.0.5" {
+		t.Fatalf("Expected host 10.0.0.5 got %s", service.Host)
+	}
+
+	if service.Port != 49153 {
+		t.Fatalf("Expected port 49153 got %d", service.Port)
+	}
+
+	if service.ExposedPort != 6379 {
+		t.Fatalf("Expected exposed port 6379 got %d", service.ExposedPort)
+	}
+
+	if service.Region != "host1" {
+		t.Fatalf("Expected region host1 got %s", service.Region)
+	}
+}
+
+func TestShutdownDeregisters(t *testing.T) {
+	defer func() {
+		quit = make(chan struct{})
+	}()
+
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	deregister, stopTimeout = true, 5
+	skydns = &mockSkydns{make(map[string]*Service)}
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"6": {
+				Image: "crosbymichael/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+				},
+			},
+		},
+	}
+
+	if err := addService("6", "crosbymichael/redis"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		events  = make(chan *docker.Event)
+		workers = &sync.WaitGroup{}
+	)
+	workers.Add(1)
+	go eventHandler(events, workers)
+
+	shutdown(workers)
+
+	if services := skydns.(*mockSkydns).services; len(services) != 0 {
+		t.Fatalf("Expected all services removed on shutdown got %d", len(services))
+	}
+}
+
+func TestLabels(t *testing.T) {
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := &docker.Container{
+		Image: "crosbymichael/redis:latest",
+		Name:  "redis1",
+		Config: &docker.ContainerConfig{
+			Labels: map[string]string{
+				"skydock.service":  "cache",
+				"skydock.instance": "primary",
+				"skydock.port":     "6379",
+				"skydock.ttl":      "15",
+			},
+		},
+		NetworkSettings: &docker.NetworkSettings{
+			IpAddress: "192.168.1.10",
+			Ports: map[string][]docker.Binding{
+				"6379/tcp":  nil,
+				"16379/tcp": nil,
+			},
+		},
+	}
+
+	services, err := p.createServices(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("Expected only the labeled port to be registered got %d services", len(services))
+	}
+
+	service := services[0]
+	if service.Name != "cache" {
+		t.Fatalf("Expected service cache got %s", service.Name)
+	}
+	if service.Version != "primary" {
+		t.Fatalf("Expected instance primary got %s", service.Version)
+	}
+	if service.Port != 6379 || service.Protocol != "tcp" {
+		t.Fatalf("Expected port 6379/tcp got %d/%s", service.Port, service.Protocol)
+	}
+	if service.TTL != 15 {
+		t.Fatalf("Expected ttl 15 got %d", service.TTL)
+	}
+
+	container.Config.Labels = map[string]string{"skydock.ignore": "true"}
+	if services, err = p.createServices(container); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 0 {
+		t.Fatalf("Expected ignored container to have no services got %d", len(services))
+	}
+
+	container.Config.Labels = nil
+	if services, err = p.createServices(container); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Name != "redis" {
+		t.Fatalf("Expected 2 redis services without labels got %d", len(services))
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	p, err := newRuntime("plugins/default.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := &docker.Container{
+		Id:    "a1b2c3d4e5f60718",
+		Image: "crosbymichael/redis:latest",
+		Name:  "redis1",
+		NetworkSettings: &docker.NetworkSettings{
+			Ports: map[string][]docker.Binding{
+				"6379/tcp": nil,
+			},
+			Networks: map[string]*docker.EndpointSettings{
+				"frontend": {IPAddress: "10.0.1.5", Aliases: []string{"a1b2c3d4e5f6", "cache"}},
+				"backend":  {IPAddress: "10.0.2.5"},
+				"host":     {},
+			},
+		},
+	}
+
+	services, err := p.createServices(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 3 {
+		t.Fatalf("Expected 3 services got %d", len(services))
+	}
+
+	for i, expected := range []struct {
+		network, host, instance string
+	}{
+		{"backend", "10.0.2.5", "redis1"},
+		{"frontend", "10.0.1.5", "redis1"},
+		{"frontend", "10.0.1.5", "cache"},
+	} {
+		service := services[i]
+		if service.Network != expected.network || service.Host != expected.host || service.Version != expected.instance {
+			t.Fatalf("Expected %s on %s at %s got %s on %s at %s", expected.instance, expected.network, expected.host,
+				service.Version, service.Network, service.Host)
+		}
+	}
+
+	if uuid := serviceUUID("a1b2c3d4e5", services[2]); uuid != "a1b2c3d4e5-frontend-6379-tcp-cache" {
+		t.Fatalf("Expected uuid a1b2c3d4e5-frontend-6379-tcp-cache got %s", uuid)
+	}
+
+	container.Config = &docker.ContainerConfig{Labels: map[string]string{"skydock.networks": "backend"}}
+	if services, err = p.createServices(container); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Network != "backend" {
+		t.Fatalf("Expected only the backend network to be registered got %d services", len(services))
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	defer func(v string) { ipVersion = v }(ipVersion)
+
+	container := &docker.Container{
+		Id:    "6",
+		Image: "crosbymichael/redis:latest",
+		Name:  "redis1",
+		NetworkSettings: &docker.NetworkSettings{
+			IpAddress:         "172.17.0.6",
+			GlobalIPv6Address: "2001:db8::6",
+			Ports: map[string][]docker.Binding{
+				"6379/tcp": nil,
+			},
+		},
+	}
+
+	for version, expected := range map[string][]string{
+		"both": {"172.17.0.6", "2001:db8::6"},
+		"v4":   {"172.17.0.6"},
+		"v6":   {"2001:db8::6"},
+	} {
+		ipVersion = version
+		p, err := newRuntime("plugins/default.js", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		services, err := p.createServices(container)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != len(expected) {
+			t.Fatalf("Expected %d services for %s got %d", len(expected), version, len(services))
+		}
+		for i, host := range expected {
+			if services[i].Host != host {
+				t.Fatalf("Expected host %s for %s got %s", host, version, services[i].Host)
+			}
+		}
+	}
+
+	v4 := &Service{Service: msg.Service{Host: "172.17.0.6"}, Protocol: "tcp", ExposedPort: 6379}
+	v6 := &Service{Service: msg.Service{Host: "2001:db8::6"}, Protocol: "tcp", ExposedPort: 6379}
+	if serviceUUID("6", v4) != "6-6379-tcp" || serviceUUID("6", v6) != "6-ipv6-6379-tcp" {
+		t.Fatalf("Expected separate uuids for ipv4 and ipv6 got %s and %s", serviceUUID("6", v4), serviceUUID("6", v6))
+	}
+}
+
+func TestPluginFailures(t *testing.T) {
+	defer func(v bool) { pluginFallback = v }(pluginFallback)
+
+	p := newTestRuntimeWithGlobals(t, `
+function createService(container) {
+    if (container.Name === "/throws") {
+        throw new Error("bad container");
+    }
+    if (container.Name === "/panics") {
+        explode();
+    }
+    return {Port: 80, Environment: defaultEnvironment, TTL: defaultTTL, Service: "app", Instance: "1", Host: container.Config.Env[0]};
+}
+`, map[string]interface{}{
+		"explode": func(call otto.FunctionCall) otto.Value {
+			panic("boom")
+		},
+	})
+	plugins = p
+
+	skydns = &mockSkydns{make(map[string]*Service)}
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {Id: "1", Image: "app", Name: "/throws", NetworkSettings: &docker.NetworkSettings{IpAddress: "10.0.0.1"}},
+			"2": {Id: "2", Image: "app", Name: "/panics", NetworkSettings: &docker.NetworkSettings{IpAddress: "10.0.0.2"}},
+			"3": {Id: "3", Image: "app", Name: "/noenv", NetworkSettings: &docker.NetworkSettings{IpAddress: "10.0.0.3"}},
+		},
+	}
+
+	before := pluginFailures.get("createService")
+
+	pluginFallback = false
+	for _, uuid := range []string{"1", "2", "3"} {
+		if err := addService(uuid, "app"); err == nil {
+			t.Fatalf("Expected plugin error for %s", uuid)
+		}
+		if isRegistered(uuid) {
+			t.Fatalf("Expected %s not to be registered", uuid)
+		}
+	}
+	if failures := pluginFailures.get("createService") - before; failures != 3 {
+		t.Fatalf("Expected 3 plugin failures got %v", failures)
+	}
+
+	pluginFallback = true
+	for _, uuid := range []string{"1", "2", "3"} {
+		if err := addService(uuid, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := skydns.(*mockSkydns).services["2"]
+	if service == nil || service.Host != "10.0.0.2" || service.Port != 80 || service.Name != "app" {
+		t.Fatalf("Expected built-in mapping for 2 got %v", service)
+	}
+}
+
+func TestPluginTimeoutTopLevel(t *testing.T) {
+	defer func(v int) { pluginTimeout = v }(pluginTimeout)
+	pluginTimeout = 50
+
+	o := otto.New()
+	o.Interrupt = make(chan func(), 1)
+	script, err := o.Compile("loop.js", "while (true) {}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runScript(o, script); err != errPluginTimeout {
+		t.Fatalf("Expected the top level code to time out got %v", err)
+	}
+}
+
+func TestPluginPool(t *testing.T) {
+	p, err := newRuntime("plugins/default.js", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.pool) != 4 {
+		t.Fatalf("Expected 4 runtimes got %d", len(p.pool))
+	}
+
+	var (
+		group  sync.WaitGroup
+		errors = make(chan error, 8)
+	)
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+
+			address := fmt.Sprintf("10.0.0.%d", i)
+			container := &docker.Container{
+				Image:           "crosbymichael/redis:latest",
+				Name:            fmt.Sprintf("/redis%d", i),
+				NetworkSettings: &docker.NetworkSettings{IpAddress: address},
+			}
+			for j := 0; j < 50; j++ {
+				services, err := p.createServices(container)
+				if err != nil {
+					errors <- err
+					return
+				}
+				if len(services) != 1 || services[0].Host != address {
+					errors <- fmt.Errorf("Expected a service on %s got %v", address, services)
+					return
+				}
+			}
+		}(i)
+	}
+	group.Wait()
+	close(errors)
+
+	for err := range errors {
+		t.Fatal(err)
+	}
+	if len(p.pool) != 4 {
+		t.Fatalf("Expected all runtimes back in the pool got %d", len(p.pool))
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	defer func(v int, f bool) { pluginTimeout, pluginFallback = v, f }(pluginTimeout, pluginFallback)
+	pluginTimeout, pluginFallback = 50, false
+
+	p := newTestRuntime(t, `
+function recurse(n) {
+    return recurse(n + 1);
+}
+
+function createService(container) {
+    if (container.Name === "/loops") {
+        while (true) {}
+    }
+    if (container.Name === "/recurses") {
+        recurse(0);
+    }
+    return {Port: 80, Environment: defaultEnvironment, TTL: defaultTTL, Service: "app", Instance: "1", Host: "10.0.0.1"};
+}
+`)
+	plugins = p
+
+	skydns = &mockSkydns{make(map[string]*Service)}
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {Id: "1", Image: "app", Name: "/loops", NetworkSettings: &docker.NetworkSettings{}},
+			"2": {Id: "2", Image: "app", Name: "/recurses", NetworkSettings: &docker.NetworkSettings{}},
+			"3": {Id: "3", Image: "app", Name: "/app", NetworkSettings: &docker.NetworkSettings{}},
+		},
+	}
+
+	before := pluginTimeouts.get("createService")
+	if err := addService("1", "app"); err == nil {
+		t.Fatal("Expected error for the plugin that loops")
+	}
+	if timeouts := pluginTimeouts.get("createService") - before; timeouts != 1 {
+		t.Fatalf("Expected 1 plugin timeout got %v", timeouts)
+	}
+
+	if err := addService("2", "app"); err == nil {
+		t.Fatal("Expected error for the plugin that recurses")
+	}
+	if timeouts := pluginTimeouts.get("createService") - before; timeouts != 1 {
+		t.Fatalf("Expected the recursion limit to stop the plugin before the timeout got %v timeouts", timeouts)
+	}
+
+	// the interrupted interpreter is still usable
+	if err := addService("3", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if !isRegistered("3") {
+		t.Fatal("Expected container 3 to be registered")
+	}
+}
+
+func TestDefaultServicesMatchPlugin(t *testing.T) {
+	defer func(e, r, h, n, v string, l int) {
+		environment, region, hostIp, networks, ipVersion, ttl = e, r, h, n, v, l
+	}(environment, region, hostIp, networks, ipVersion, ttl)
+	environment, networks, ipVersion, ttl = "dev", "", "both", 30
+
+	container := &docker.Container{
+		Id:     "0123456789abcdef",
+		Image:  "crosbymichael/redis:latest",
+		Name:   "/redis1",
+		Config: &docker.ContainerConfig{},
+		NetworkSettings: &docker.NetworkSettings{
+			Ports: map[string][]docker.Binding{
+				"6379/tcp": {{HostIp: "", HostPort: "49153"}},
+				"53/udp":   {{HostIp: "192.168.1.5", HostPort: "5353"}},
+				"8080/tcp": nil,
+			},
+			Networks: map[string]*docker.EndpointSettings{
+				"frontend": {IPAddress: "10.0.1.2", GlobalIPv6Address: "fd00::2", Aliases: []string{"cache", "0123456789ab"}},
+				"backend":  {IPAddress: "10.0.2.2"},
+			},
+		},
+	}
+
+	for _, r := range []string{"", "east"} {
+		region, hostIp = r, "10.0.0.1"
+
+		p, err := newRuntime("plugins/default.js", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := p.createServices(container)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		services := make(map[string]string)
+		for _, service := range defaultServices(container) {
+			services[serviceUUID("1", service)] = fmt.Sprintf("%+v", *service)
+		}
+		if len(services) != len(expected) {
+			t.Fatalf("Expected %d services in region %q got %d", len(expected), r, len(services))
+		}
+		for _, service := range expected {
+			uuid := serviceUUID("1", service)
+			if s := fmt.Sprintf("%+v", *service); services[uuid] != s {
+				t.Fatalf("Expected %s in region %q got %s", s, r, services[uuid])
+			}
+		}
+	}
+}
+
+func TestPluginPanicReplacesInterpreter(t *testing.T) {
+	p := newTestRuntimeWithGlobals(t, `
+var calls = 0;
+
+function createService(container) {
+    calls++;
+    if (container.Name === "/panics") {
+        explode();
+    }
+    return {Port: 80, Environment: defaultEnvironment, TTL: defaultTTL, Service: "app", Instance: String(calls), Host: "10.0.0.1"};
+}
+`, map[string]interface{}{
+		"explode": func(call otto.FunctionCall) otto.Value {
+			panic("boom")
+		},
+	})
+
+	instance := func(name string) string {
+		services, err := p.createServices(&docker.Container{Name: name, NetworkSettings: &docker.NetworkSettings{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return services[0].Version
+	}
+
+	instance("/app")
+	if v := instance("/app"); v != "2" {
+		t.Fatalf("Expected the interpreter to keep its globals got instance %s", v)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := p.createServices(&docker.Container{Name: "/panics", NetworkSettings: &docker.NetworkSettings{}})
+		if _, ok := err.(*pluginPanic); !ok {
+			t.Fatalf("Expected the plugin to panic got %v", err)
+		}
+	}
+	if v := instance("/app"); v != "1" {
+		t.Fatalf("Expected a fresh interpreter after the panic got instance %s", v)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns1/client"
+)
+
+var (
+	dockerEvents = newCounter("skydock_docker_events_total",
+		"Docker events received by status.", "status")
+	backendRequests = newCounter("skydock_backend_requests_total",
+		"Requests to the backend by operation and result.", "operation", "result")
+	pluginFailures = newCounter("skydock_plugin_failures_total",
+		"Plugin calls that failed by function.", "function")
+	pluginTimeouts = newCounter("skydock_plugin_timeouts_total",
+		"Plugin calls that were interrupted for running longer than -plugin-timeout by function.", "function")
+	pluginDuration = newHistogram("skydock_plugin_duration_seconds",
+		"Time spent in the createService plugin.", []float64{.001, .005, .01, .05, .1, .5, 1, 5})
+	heartbeatLag = newHistogram("skydock_heartbeat_lag_seconds",
+		"Time between when a heartbeat was due and when it was sent.", []float64{.1, .5, 1, 2, 5, 10, 30})
+)
+
+// counter is a prometheus counter with a value for every set of label values
+type counter struct {
+	sync.Mutex
+
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// inc adds one to the counter for the label values given in
+// the same order as the counter's labels
+func (c *counter) inc(values ...string) {
+	key := c.key(values)
+
+	c.Lock()
+	c.values[key]++
+	c.Unlock()
+}
+
+func (c *counter) get(values ...string) float64 {
+	key := c.key(values)
+
+	c.Lock()
+	defer c.Unlock()
+	return c.values[key]
+}
+
+// key returns the label pairs for the values as written in the metrics
+func (c *counter) key(values []string) string {
+	pairs := make([]string, len(c.labels))
+	for i, label := range c.labels {
+		pairs[i] = fmt.Sprintf("%s=%q", label, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (c *counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %v\n", c.name, c.values[""])
+		return
+	}
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %v\n", c.name, key, c.values[key])
+	}
+}
+
+// histogram is a prometheus histogram of durations in seconds
+type histogram struct {
+	sync.Mutex
+
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+
+	h.Lock()
+	defer h.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// metricsHandler writes all the metrics in the prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	dockerEvents.write(w)
+	backendRequests.write(w)
+	pluginFailures.write(w)
+	pluginTimeouts.write(w)
+	pluginDuration.write(w)
+	heartbeatLag.write(w)
+
+	var services int
+	for _, uuid := range registeredServices() {
+		services += len(containerServices(uuid))
+	}
+	fmt.Fprintf(w, "# HELP skydock_registered_services Services currently registered.\n")
+	fmt.Fprintf(w, "# TYPE skydock_registered_services gauge\nskydock_registered_services %d\n", services)
+}
+
+// instrumentedBackend counts the requests to the backend by result
+type instrumentedBackend struct {
+	Skydns
+}
+
+func (b *instrumentedBackend) Add(uuid string, service *Service) error {
+	err := b.Skydns.Add(uuid, service)
+	backendRequests.inc("add", requestResult(err))
+	return err
+}
+
+func (b *instrumentedBackend) Update(uuid string, ttl uint32) error {
+	err := b.Skydns.Update(uuid, ttl)
+	backendRequests.inc("update", requestResult(err))
+	return err
+}
+
+func (b *instrumentedBackend) Delete(uuid string) error {
+	err := b.Skydns.Delete(uuid)
+	backendRequests.inc("delete", requestResult(err))
+	return err
+}
+
+func requestResult(err error) string {
+	switch err {
+	case nil:
+		return "success"
+	case client.ErrConflictingUUID:
+		return "conflict"
+	case client.ErrServiceNotFound:
+		return "not_found"
+	}
+	return "error"
+}
+
+// countPluginFailure counts the failed plugin call and, if the plugin was
+// interrupted, the timeout
+func countPluginFailure(function string, err error) {
+	pluginFailures.inc(function)
+	if err == errPluginTimeout {
+		pluginTimeouts.inc(function)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns1/msg"
+)
+
+func TestCounterWrite(t *testing.T) {
+	c := newCounter("test_total", "Test counter.", "operation", "result")
+	c.inc("add", "success")
+	c.inc("add", "success")
+	c.inc("delete", "error")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{operation="add",result="success"} 2
+test_total{operation="delete",result="error"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected %q got %q", expected, buf.String())
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram("test_seconds", "Test histogram.", []float64{.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(500 * time.Millisecond)
+	h.observe(2 * time.Second)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 2.55
+test_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected %q got %q", expected, buf.String())
+	}
+}
+
+func TestInstrumentedBackend(t *testing.T) {
+	backend := &instrumentedBackend{&mockSkydns{make(map[string]*Service)}}
+	service := &Service{Service: msg.Service{Name: "redis"}}
+
+	before := map[string]float64{
+		"success":   backendRequests.get("add", "success"),
+		"conflict":  backendRequests.get("add", "conflict"),
+		"not_found": backendRequests.get("delete", "not_found"),
+	}
+
+	backend.Add("1", service)
+	backend.Add("1", service)
+	backend.Delete("2")
+
+	if backendRequests.get("add", "success")-before["success"] != 1 {
+		t.Fatal("Expected add to be counted as success")
+	}
+	if backendRequests.get("add", "conflict")-before["conflict"] != 1 {
+		t.Fatal("Expected duplicate add to be counted as conflict")
+	}
+	if backendRequests.get("delete", "not_found")-before["not_found"] != 1 {
+		t.Fatal("Expected delete of unknown service to be counted as not found")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	registered = make(map[string][]*Service)
+	registerService("1", &Service{Service: msg.Service{UUID: "1-80-tcp"}})
+	registerService("1", &Service{Service: msg.Service{UUID: "1-443-tcp"}})
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, expected := range []string{
+		"# TYPE skydock_docker_events_total counter",
+		"# TYPE skydock_plugin_duration_seconds histogram",
+		"# TYPE skydock_heartbeat_lag_seconds histogram",
+		"skydock_registered_services 2\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected metrics to contain %q got:\n%s", expected, body)
+		}
+	}
+}
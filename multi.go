@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crosbymichael/log"
+	"github.com/skynetservices/skydns1/client"
+)
+
+var (
+	backendRetries    = 3
+	backendRetryDelay = 500 * time.Millisecond
+)
+
+// multiBackend is a Skydns implementation that applies every change to
+// several backends.  A failing backend does not stop the others from being
+// updated.  Services that could not be added to a backend are added again
+// on the next heartbeat.
+type multiBackend struct {
+	sync.Mutex
+
+	names    []string
+	backends []Skydns
+	services map[string]*Service
+	missing  map[string]map[int]bool // uuid -> backends without the service
+}
+
+func newMultiBackend(names []string, backends []Skydns) *multiBackend {
+	return &multiBackend{
+		names:    names,
+		backends: backends,
+		services: make(map[string]*Service),
+		missing:  make(map[string]map[int]bool),
+	}
+}
+
+// Add adds the service to all the backends and only fails if
+// the service could not be added to any of them
+func (m *multiBackend) Add(uuid string, service *Service) error {
+	var (
+		errs    []string
+		missing = make(map[int]bool)
+	)
+	for i := range m.backends {
+		if err := m.add(i, uuid, service); err != nil {
+			missing[i] = true
+			errs = append(errs, fmt.Sprintf("%s: %s", m.names[i], err))
+		}
+	}
+
+	if len(missing) == len(m.backends) {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	m.Lock()
+	m.services[uuid] = service
+	m.missing[uuid] = missing
+	m.Unlock()
+	return nil
+}
+
+// Delete removes the service from all the backends
+func (m *multiBackend) Delete(uuid string) error {
+	m.Lock()
+	_, exists := m.services[uuid]
+	delete(m.services, uuid)
+	delete(m.missing, uuid)
+	m.Unlock()
+
+	var (
+		errs     []string
+		notFound int
+	)
+	for i, b := range m.backends {
+		err := retry(func() error { return b.Delete(uuid) })
+		switch err {
+		case nil:
+		case client.ErrServiceNotFound:
+			notFound++
+		default:
+			log.Logf(log.ERROR, "error removing %s from %s: %s", uuid, m.names[i], err)
+			errs = append(errs, fmt.Sprintf("%s: %s", m.names[i], err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	if !exists && notFound == len(m.backends) {
+		return client.ErrServiceNotFound
+	}
+	return nil
+}
+
+// Update refreshes the ttl of the service in all the backends and adds it
+// to the backends that it is missing from.  It only fails if the service
+// could not be updated in any of the backends.
+func (m *multiBackend) Update(uuid string, ttl uint32) error {
+	m.Lock()
+	service, exists := m.services[uuid]
+	missing := m.missing[uuid]
+	m.Unlock()
+	if !exists {
+		return client.ErrServiceNotFound
+	}
+
+	var (
+		errs  []string
+		still = make(map[int]bool)
+	)
+	for i, b := range m.backends {
+		var err error
+		if missing[i] {
+			err = m.add(i, uuid, service)
+		} else if err = b.Update(uuid, ttl); err == client.ErrServiceNotFound {
+			// the backend lost the service so add it again
+			err = m.add(i, uuid, service)
+		}
+
+		if err != nil {
+			still[i] = true
+			errs = append(errs, fmt.Sprintf("%s: %s", m.names[i], err))
+		}
+	}
+
+	m.Lock()
+	if _, exists := m.services[uuid]; exists {
+		m.missing[uuid] = still
+	}
+	m.Unlock()
+
+	if len(still) == len(m.backends) {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// add adds the service to a single backend retrying on errors
+func (m *multiBackend) add(i int, uuid string, service *Service) error {
+	b := m.backends[i]
+	err := retry(func() error {
+		err := b.Add(uuid, service)
+		if err == client.ErrConflictingUUID {
+			return b.Update(uuid, service.TTL)
+		}
+		return err
+	})
+	if err != nil {
+		log.Logf(log.ERROR, "error adding %s to %s: %s", uuid, m.names[i], err)
+	}
+	return err
+}
+
+// retry calls fn until it succeeds, returns ErrServiceNotFound or
+// the retries are used up
+func retry(fn func() error) error {
+	var (
+		err   error
+		delay = backendRetryDelay
+	)
+	for i := 0; i < backendRetries; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = fn(); err == nil || err == client.ErrServiceNotFound {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// failingSkydns fails the next n calls before passing them to the mock
+type failingSkydns struct {
+	mockSkydns
+	failures int
+}
+
+func (s *failingSkydns) fail() error {
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("backend unavailable")
+	}
+	return nil
+}
+
+func (s *failingSkydns) Add(uuid string, service *Service) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.mockSkydns.Add(uuid, service)
+}
+
+func (s *failingSkydns) Update(uuid string, ttl uint32) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.mockSkydns.Update(uuid, ttl)
+}
+
+func (s *failingSkydns) Delete(uuid string) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.mockSkydns.Delete(uuid)
+}
+
+func TestMultiBackend(t *testing.T) {
+	backendRetryDelay = 0
+
+	var (
+		healthy = &mockSkydns{make(map[string]*Service)}
+		flaky   = &failingSkydns{mockSkydns{make(map[string]*Service)}, backendRetries}
+		m       = newMultiBackend([]string{"healthy", "flaky"}, []Skydns{healthy, flaky})
+		service = &Service{Service: msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.2", TTL: 30}}
+	)
+
+	// the flaky backend uses up all the retries
+	if err := m.Add("1", service); err != nil {
+		t.Fatal(err)
+	}
+	if healthy.services["1"] == nil {
+		t.Fatal("Service not added to the healthy backend")
+	}
+	if flaky.services["1"] != nil {
+		t.Fatal("Service added to the flaky backend")
+	}
+
+	// the heartbeat adds it to the backend that missed it
+	if err := m.Update("1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if flaky.services["1"] == nil {
+		t.Fatal("Service not added to the flaky backend on update")
+	}
+
+	// a backend that lost the service gets it again
+	delete(healthy.services, "1")
+	if err := m.Update("1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if healthy.services["1"] == nil {
+		t.Fatal("Service not added again to the healthy backend on update")
+	}
+
+	if err := m.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(healthy.services) != 0 || len(flaky.services) != 0 {
+		t.Fatal("Service not removed from all backends")
+	}
+}
+
+func TestMultiBackendAllFail(t *testing.T) {
+	backendRetryDelay = 0
+
+	var (
+		a = &failingSkydns{mockSkydns{make(map[string]*Service)}, backendRetries}
+		b = &failingSkydns{mockSkydns{make(map[string]*Service)}, backendRetries}
+		m = newMultiBackend([]string{"a", "b"}, []Skydns{a, b})
+	)
+
+	if err := m.Add("1", &Service{}); err == nil {
+		t.Fatal("Expected error when all backends fail")
+	}
+}
@@ -1,27 +1,63 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/crosbymichael/log"
 	"github.com/crosbymichael/skydock/docker"
 	"github.com/crosbymichael/skydock/utils"
 	"github.com/robertkrimen/otto"
-	"github.com/skynetservices/skydns1/msg"
 )
 
+// pluginStackDepth limits how deep plugins can recurse before they get a RangeError
+const pluginStackDepth = 1000
+
+// errPluginTimeout is returned for plugins interrupted for running longer
+// than -plugin-timeout.  otto only checks for interrupts between statements
+// and expressions so a single long call to a builtin is not interrupted.
+var errPluginTimeout = errors.New("plugin interrupted after running longer than -plugin-timeout")
+
+// pluginRuntime runs the plugins in a pool of interpreters because otto is
+// not safe for concurrent use.  Every interpreter runs the same compiled
+// script so plugins can keep global state without locking.  An interpreter
+// whose plugin panicked is replaced because its globals may be half updated.
 type pluginRuntime struct {
-	o *otto.Otto
+	script   *otto.Script
+	size     int
+	pool     chan *otto.Otto
+	defaults func(*otto.Otto) error
+}
+
+// pluginPanic is the error for a plugin, or otto while running it, that panicked
+type pluginPanic struct {
+	name  string
+	value interface{}
+}
+
+func (p *pluginPanic) Error() string {
+	return fmt.Sprintf("%s plugin panicked: %v", p.name, p.value)
 }
 
-func (r *pluginRuntime) createService(container *docker.Container) (*msg.Service, error) {
-	value, err := r.o.ToValue(*container)
+// createServices calls the createService plugin for the container.  The plugin
+// can return a single service or an array with a service for each port.
+func (r *pluginRuntime) createServices(container *docker.Container) (services []*Service, err error) {
+	o := r.get()
+	defer func() { r.put(o, err) }()
+	defer interruptAfter(o, time.Duration(pluginTimeout)*time.Millisecond)()
+	defer recoverPlugin("createService", &err)
+
+	value, err := o.ToValue(*container)
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := r.o.Call("createService", nil, value)
+	result, err := o.Call("createService", nil, value)
 	if err != nil {
 		return nil, err
 	}
@@ -30,10 +66,295 @@ func (r *pluginRuntime) createService(container *docker.Container) (*msg.Service
 		return nil, fmt.Errorf("createService plugin did not return a valid object")
 	}
 
+	obj := result.Object()
+	if obj.Class() != "Array" {
+		return toServices(obj)
+	}
+
+	length, err := getInt(obj, "length")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < int(length); i++ {
+		v, err := obj.Get(strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		if !v.IsObject() {
+			return nil, fmt.Errorf("createService plugin did not return a valid object at index %d", i)
+		}
+		out, err := toServices(v.Object())
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, out...)
+	}
+	return services, nil
+}
+
+// recoverPlugin returns the panic of a plugin, or of otto while running
+// it, as an error so that one container cannot crash skydock
+func recoverPlugin(name string, err *error) {
+	if r := recover(); r != nil {
+		if r == errPluginTimeout {
+			log.Logf(log.ERROR, "%s plugin interrupted after %dms", name, pluginTimeout)
+			*err = errPluginTimeout
+			return
+		}
+		*err = &pluginPanic{name, r}
+	}
+}
+
+// interruptAfter interrupts the plugin running in the interpreter once the
+// timeout expires.  The returned function has to be called when the plugin
+// returns so that a late interrupt does not stop the next call.
+func interruptAfter(o *otto.Otto, timeout time.Duration) func() {
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	fired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		o.Interrupt <- func() {
+			panic(errPluginTimeout)
+		}
+		close(fired)
+	})
+	return func() {
+		if timer.Stop() {
+			return
+		}
+		<-fired
+		select {
+		case <-o.Interrupt:
+		default:
+		}
+	}
+}
+
+// defaultServices is the built-in mapping used when the plugins fail.  It
+// registers the container like the default plugin without labels, a service
+// for every port on every network and address along with the network aliases,
+// or on the published host ports in multihost mode.
+func defaultServices(container *docker.Container) []*Service {
+	if container.NetworkSettings == nil {
+		return nil
+	}
+
 	var (
-		obj     = result.Object()
-		service = &msg.Service{}
+		services []*Service
+		ports    = containerPorts(container.NetworkSettings)
 	)
+	newService := func(host string, port, exposedPort int, protocol string) *Service {
+		service := &Service{Protocol: protocol, ExposedPort: uint16(exposedPort)}
+		service.Name = utils.CleanImageName(container.Image)
+		service.Version = utils.RemoveSlash(container.Name)
+		service.Environment = environment
+		service.Region = region
+		service.TTL = uint32(ttl)
+		service.Host = host
+		service.Port = uint16(port)
+		return service
+	}
+
+	if region != "" {
+		// in multihost mode only published ports can be reached from other hosts
+		for _, p := range ports {
+			if p.hostPort > 0 {
+				services = append(services, newService(p.hostIp, p.hostPort, p.port, p.protocol))
+			}
+		}
+		return services
+	}
+
+	if len(ports) == 0 {
+		ports = []containerPort{{port: 80}}
+	}
+
+	for _, network := range containerNetworks(container) {
+		for _, address := range network.addresses {
+			for _, p := range ports {
+				service := newService(address, p.port, p.port, p.protocol)
+				service.Network = network.name
+				services = append(services, service)
+
+				for _, alias := range network.aliases {
+					if alias == "" || alias == service.Version {
+						continue
+					}
+					aliased := *service
+					aliased.Version = alias
+					aliased.Alias = true
+					services = append(services, &aliased)
+				}
+			}
+		}
+	}
+	return services
+}
+
+// containerPort is a port of the container with its first host binding
+type containerPort struct {
+	port     int
+	protocol string
+	hostIp   string
+	hostPort int
+}
+
+// containerPorts returns the ports that the container publishes or exposes
+// sorted by port like getPorts in the default plugin
+func containerPorts(settings *docker.NetworkSettings) []containerPort {
+	var out []containerPort
+	for key, bindings := range settings.Ports {
+		parts := strings.SplitN(key, "/", 2)
+		port, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+
+		p := containerPort{port: port, protocol: "tcp"}
+		if len(parts) == 2 {
+			p.protocol = parts[1]
+		}
+		if len(bindings) > 0 {
+			p.hostIp = bindings[0].HostIp
+			p.hostPort, _ = strconv.Atoi(bindings[0].HostPort)
+			if p.hostIp == "" || p.hostIp == "0.0.0.0" {
+				p.hostIp = hostIp
+			}
+		}
+		out = append(out, p)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].port != out[j].port {
+			return out[i].port < out[j].port
+		}
+		return out[i].protocol < out[j].protocol
+	})
+	return out
+}
+
+// containerNetwork is a network the container is registered on
+type containerNetwork struct {
+	name      string
+	addresses []string
+	aliases   []string
+}
+
+// containerNetworks returns the networks selected by -networks sorted by name
+// like getNetworks in the default plugin.  Containers without networks are
+// registered with their legacy addresses.
+func containerNetworks(container *docker.Container) []containerNetwork {
+	settings := container.NetworkSettings
+	if len(settings.Networks) == 0 {
+		return []containerNetwork{{addresses: ipAddresses(settings.IpAddress, settings.GlobalIPv6Address)}}
+	}
+
+	names := make([]string, 0, len(settings.Networks))
+	for name := range settings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	selected := strings.Split(networks, ",")
+	var out []containerNetwork
+	for _, name := range names {
+		network := settings.Networks[name]
+		if network == nil || (networks != "" && !containsString(selected, name)) {
+			continue
+		}
+
+		addresses := ipAddresses(network.IPAddress, network.GlobalIPv6Address)
+		if len(addresses) == 0 {
+			continue
+		}
+
+		var aliases []string
+		for _, alias := range network.Aliases {
+			// docker adds the short container id to every user defined network
+			if !strings.HasPrefix(container.Id, alias) {
+				aliases = append(aliases, alias)
+			}
+		}
+		out = append(out, containerNetwork{name: name, addresses: addresses, aliases: aliases})
+	}
+	return out
+}
+
+// ipAddresses returns the ipv4 and ipv6 addresses to register for -ip
+func ipAddresses(ipv4, ipv6 string) []string {
+	var out []string
+	if ipv4 != "" && ipVersion != "v6" {
+		out = append(out, ipv4)
+	}
+	if ipv6 != "" && ipVersion != "v4" {
+		out = append(out, ipv6)
+	}
+	return out
+}
+
+// toServices converts a service returned by the createService plugin
+// along with a copy for each of its Aliases
+func toServices(obj *otto.Object) ([]*Service, error) {
+	service, err := toService(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := getOptionalStrings(obj, "Aliases")
+	if err != nil {
+		return nil, err
+	}
+
+	services := []*Service{service}
+	for _, alias := range aliases {
+		if alias == "" || alias == service.Version {
+			continue
+		}
+		aliased := *service
+		aliased.Version = alias
+		aliased.Alias = true
+		services = append(services, &aliased)
+	}
+	return services, nil
+}
+
+// shouldRegister calls the optional shouldRegister plugin for the container
+// and returns true if the plugin does not define it
+func (r *pluginRuntime) shouldRegister(container *docker.Container) (ok bool, err error) {
+	o := r.get()
+	defer func() { r.put(o, err) }()
+	defer interruptAfter(o, time.Duration(pluginTimeout)*time.Millisecond)()
+	defer recoverPlugin("shouldRegister", &err)
+
+	fn, err := o.Get("shouldRegister")
+	if err != nil {
+		return false, err
+	}
+	if !fn.IsFunction() {
+		return true, nil
+	}
+
+	value, err := o.ToValue(*container)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := fn.Call(otto.NullValue(), value)
+	if err != nil {
+		return false, err
+	}
+	if !result.IsBoolean() {
+		return false, fmt.Errorf("shouldRegister plugin did not return a boolean")
+	}
+	return result.ToBoolean()
+}
+
+// toService converts a service returned by the createService plugin
+func toService(obj *otto.Object) (*Service, error) {
+	service := &Service{}
 
 	rawTTL, err := getInt(obj, "TTL")
 	if err != nil {
@@ -45,6 +366,11 @@ func (r *pluginRuntime) createService(container *docker.Container) (*msg.Service
 		return nil, err
 	}
 
+	rawExposedPort, err := getOptionalInt(obj, "ExposedPort", rawPort)
+	if err != nil {
+		return nil, err
+	}
+
 	if service.Name, err = getString(obj, "Service"); err != nil {
 		return nil, err
 	}
@@ -57,15 +383,32 @@ func (r *pluginRuntime) createService(container *docker.Container) (*msg.Service
 	if service.Environment, err = getString(obj, "Environment"); err != nil {
 		return nil, err
 	}
+	if service.Protocol, err = getOptionalString(obj, "Protocol"); err != nil {
+		return nil, err
+	}
+	if service.Region, err = getOptionalString(obj, "Region"); err != nil {
+		return nil, err
+	}
+	if service.Network, err = getOptionalString(obj, "Network"); err != nil {
+		return nil, err
+	}
 	service.TTL = uint32(rawTTL)
 	service.Port = uint16(rawPort)
+	service.ExposedPort = uint16(rawExposedPort)
+	service.Protocol = strings.ToLower(service.Protocol)
 
 	// I'm glad that is over
 	return service, nil
 }
 
-func newRuntime(file string) (*pluginRuntime, error) {
-	runtime := otto.New()
+// newRuntime compiles the plugins in the file and runs them in size interpreters
+func newRuntime(file string, size int) (*pluginRuntime, error) {
+	return loadRuntime(file, size, loadDefaults)
+}
+
+// loadRuntime compiles the plugins in the file and runs them in size
+// interpreters whose globals are set by defaults
+func loadRuntime(file string, size int, defaults func(*otto.Otto) error) (*pluginRuntime, error) {
 	log.Logf(log.INFO, "loading plugins from %s", file)
 
 	content, err := ioutil.ReadFile(file)
@@ -73,14 +416,76 @@ func newRuntime(file string) (*pluginRuntime, error) {
 		return nil, err
 	}
 
-	if _, err := runtime.Run(string(content)); err != nil {
+	script, err := otto.New().Compile(file, content)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := loadDefaults(runtime); err != nil {
+	r := &pluginRuntime{
+		script:   script,
+		size:     size,
+		pool:     make(chan *otto.Otto, size),
+		defaults: defaults,
+	}
+	for i := 0; i < size; i++ {
+		runtime, err := r.newInterpreter()
+		if err != nil {
+			return nil, err
+		}
+		r.pool <- runtime
+	}
+	return r, nil
+}
+
+// newInterpreter returns an interpreter that has run the plugins
+func (r *pluginRuntime) newInterpreter() (*otto.Otto, error) {
+	runtime := otto.New()
+	runtime.Interrupt = make(chan func(), 1)
+	runtime.SetStackDepthLimit(pluginStackDepth)
+	if err := r.defaults(runtime); err != nil {
 		return nil, err
 	}
-	return &pluginRuntime{runtime}, nil
+	if err := runScript(runtime, r.script); err != nil {
+		return nil, err
+	}
+	return runtime, nil
+}
+
+// runScript runs the top level code of the plugins with the same limits as the functions
+func runScript(o *otto.Otto, script *otto.Script) (err error) {
+	defer interruptAfter(o, time.Duration(pluginTimeout)*time.Millisecond)()
+	defer recoverPlugin("top level", &err)
+
+	_, err = o.Run(script)
+	return err
+}
+
+// get takes an interpreter from the pool waiting for one to be free
+func (r *pluginRuntime) get() *otto.Otto {
+	return <-r.pool
+}
+
+// hasFunction returns true if the plugins define a function with the name
+func (r *pluginRuntime) hasFunction(name string) bool {
+	o := r.get()
+	defer r.put(o, nil)
+
+	fn, err := o.Get(name)
+	return err == nil && fn.IsFunction()
+}
+
+// put returns the interpreter to the pool after the plugin returned err.
+// Interpreters that panicked or were interrupted are replaced.
+func (r *pluginRuntime) put(o *otto.Otto, err error) {
+	if _, panicked := err.(*pluginPanic); panicked || err == errPluginTimeout {
+		fresh, newErr := r.newInterpreter()
+		if newErr != nil {
+			log.Logf(log.ERROR, "error replacing plugin interpreter, keeping the old one: %s", newErr)
+		} else {
+			o = fresh
+		}
+	}
+	r.pool <- o
 }
 
 func loadDefaults(runtime *otto.Otto) error {
@@ -90,6 +495,21 @@ func loadDefaults(runtime *otto.Otto) error {
 	if err := runtime.Set("defaultEnvironment", environment); err != nil {
 		return err
 	}
+	if err := runtime.Set("defaultRegion", region); err != nil {
+		return err
+	}
+	if err := runtime.Set("defaultHost", hostIp); err != nil {
+		return err
+	}
+	if err := runtime.Set("defaultNetworks", networks); err != nil {
+		return err
+	}
+	if err := runtime.Set("defaultIPVersion", ipVersion); err != nil {
+		return err
+	}
+	if err := runtime.Set("settings", pluginSettings); err != nil {
+		return err
+	}
 	if err := runtime.Set("cleanImageName", func(call otto.FunctionCall) otto.Value {
 		name := call.Argument(0).String()
 		result, _ := otto.ToValue(utils.CleanImageName(name))
@@ -124,3 +544,44 @@ func getInt(obj *otto.Object, name string) (int64, error) {
 	}
 	return v.ToInteger()
 }
+
+// getOptionalString returns an empty string if the field is not set
+func getOptionalString(obj *otto.Object, name string) (string, error) {
+	v, err := obj.Get(name)
+	if err != nil || !v.IsDefined() || v.IsNull() {
+		return "", err
+	}
+	return v.ToString()
+}
+
+// getOptionalStrings returns the strings in the array or nil if it is not set
+func getOptionalStrings(obj *otto.Object, name string) ([]string, error) {
+	v, err := obj.Get(name)
+	if err != nil || !v.IsDefined() || v.IsNull() {
+		return nil, err
+	}
+	if !v.IsObject() || v.Object().Class() != "Array" {
+		return nil, fmt.Errorf("%s must be an array", name)
+	}
+
+	length, err := getInt(v.Object(), "length")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, length)
+	for i := range out {
+		if out[i], err = getString(v.Object(), strconv.Itoa(i)); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// getOptionalInt returns the fallback if the field is not set
+func getOptionalInt(obj *otto.Object, name string, fallback int64) (int64, error) {
+	v, err := obj.Get(name)
+	if err != nil || !v.IsDefined() || v.IsNull() {
+		return fallback, err
+	}
+	return v.ToInteger()
+}
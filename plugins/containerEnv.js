@@ -8,6 +8,7 @@ function createService(container) {
     return {
         Port: 80,
         Environment: env.DNS_ENVIRONMENT || defaultEnvironment,
+        Region: env.DNS_REGION || defaultRegion,
         TTL: env.DNS_TTL || defaultTTL,
         Service: env.DNS_SERVICE || cleanImageName(container.Image),
         Instance: env.DNS_INSTANCE || removeSlash(container.Name),
@@ -1,39 +1,179 @@
+// The default plugin can be configured per container with labels:
+//
+//   skydock.ignore    do not register the container when set to true
+//   skydock.service   service name instead of the image name
+//   skydock.instance  instance name instead of the container name
+//   skydock.port      only register this port, as port or port/protocol
+//   skydock.ttl       ttl in seconds instead of the -ttl flag
+//   skydock.networks  comma separated networks to register the container on
 function createService(container) {
-    var port = getDefaultPort(container);
+    var labels = getLabels(container);
+    if (labels["skydock.ignore"] === "true") {
+        return [];
+    }
+
+    var services = [];
+    var ports = filterPorts(getPorts(container), labels["skydock.port"]);
+    if (defaultRegion !== "") {
+        // in multihost mode only published ports can be reached from other hosts
+        for (var i = 0; i < ports.length; i++) {
+            var p = ports[i];
+            if (p.hostPort > 0) {
+                services.push(newService(container, labels, p.hostIp, p.hostPort, p.port, p.protocol));
+            }
+        }
+        return services;
+    }
+
+    if (ports.length === 0) {
+        // containers without any ports get a single service on port 80
+        ports = [{port: 80, protocol: ""}];
+    }
+
+    var networks = getNetworks(container, labels);
+    for (var n = 0; n < networks.length; n++) {
+        var network = networks[n];
+        for (var a = 0; a < network.addresses.length; a++) {
+            for (var i = 0; i < ports.length; i++) {
+                var service = newService(container, labels, network.addresses[a], ports[i].port, ports[i].port, ports[i].protocol);
+                service.Network = network.name;
+                service.Aliases = network.aliases;
+                services.push(service);
+            }
+        }
+    }
+    return services;
+}
+
+function newService(container, labels, host, port, exposedPort, protocol) {
+    var ttl = parseInt(labels["skydock.ttl"]);
     return {
         Port: port,
+        ExposedPort: exposedPort,
+        Protocol: protocol,
         Environment: defaultEnvironment,
-        TTL: defaultTTL,
-        Service: cleanImageName(container.Image),
-        Instance: removeSlash(container.Name),
-        Host: container.NetworkSettings.IpAddress
-    }; 
-}
-
-function getDefaultPort(container) {
-    // if we have any exposed ports use those
-    var port = 0;
-    var ports = container.NetworkSettings.Ports;
-    if (Object.keys(ports).length > 0) {
-        for (var key in ports) {
-            var value = ports[key];
-            if (value !== null && value.length > 0) {
-                for (var i = 0; i < value.length; i++) {
-                    var hp = parseInt(value[i].HostPort);
-                    if (port === 0 || hp < port) {
-                        port = hp; 
-                    }
-                }  
-            } else if (port === 0) {
-                // just grab the key value 
-                var expose = parseInt(key.split("/")[0]); 
-                port = expose;
+        Region: defaultRegion,
+        TTL: ttl > 0 ? ttl : defaultTTL,
+        Service: labels["skydock.service"] || cleanImageName(container.Image),
+        Instance: labels["skydock.instance"] || removeSlash(container.Name),
+        Host: host
+    };
+}
+
+// getLabels returns the labels of the container or an empty
+// object if it has none
+function getLabels(container) {
+    if (container.Config && container.Config.Labels) {
+        return container.Config.Labels;
+    }
+    return {};
+}
+
+// getNetworks returns the name, addresses and aliases of every network that
+// the container is registered on sorted by name.  Containers without networks
+// are registered with their legacy addresses.
+function getNetworks(container, labels) {
+    var settings = container.NetworkSettings.Networks || {};
+    var selected = (labels["skydock.networks"] || defaultNetworks).split(",");
+    var all = selected.length === 1 && selected[0] === "";
+
+    var out = [];
+    var found = false;
+    for (var name in settings) {
+        found = true;
+        var network = settings[name];
+        if (!network || (!all && selected.indexOf(name) === -1)) {
+            continue;
+        }
+        var addresses = getAddresses(network.IPAddress, network.GlobalIPv6Address);
+        if (addresses.length > 0) {
+            out.push({name: name, addresses: addresses, aliases: getAliases(container, network.Aliases)});
+        }
+    }
+
+    if (!found) {
+        var legacy = container.NetworkSettings;
+        return [{name: "", addresses: getAddresses(legacy.IpAddress, legacy.GlobalIPv6Address), aliases: []}];
+    }
+
+    out.sort(function(a, b) {
+        return a.name < b.name ? -1 : 1;
+    });
+    return out;
+}
+
+// getAddresses returns the ipv4 and ipv6 addresses to register
+// for the -ip flag, v4, v6 or both
+function getAddresses(ipv4, ipv6) {
+    var out = [];
+    if (ipv4 && defaultIPVersion !== "v6") {
+        out.push(ipv4);
+    }
+    if (ipv6 && defaultIPVersion !== "v4") {
+        out.push(ipv6);
+    }
+    return out;
+}
+
+// getAliases returns the network aliases of the container without the
+// short container id that docker adds to every user defined network
+function getAliases(container, aliases) {
+    var out = [];
+    for (var i = 0; aliases && i < aliases.length; i++) {
+        if (container.Id.indexOf(aliases[i]) !== 0) {
+            out.push(aliases[i]);
+        }
+    }
+    return out;
+}
+
+// filterPorts returns only the port given in the skydock.port label.
+// A port that the container does not expose or publish is still
+// registered so that services listening on unexposed ports work.
+function filterPorts(ports, label) {
+    if (!label) {
+        return ports;
+    }
+
+    var parts = label.split("/");
+    var port = parseInt(parts[0]);
+    var protocol = parts[1] || "tcp";
+    for (var i = 0; i < ports.length; i++) {
+        if (ports[i].port === port && ports[i].protocol === protocol) {
+            return [ports[i]];
+        }
+    }
+    return [{port: port, protocol: protocol, hostIp: "", hostPort: 0}];
+}
+
+// getPorts returns the port and protocol of every port that the
+// container publishes or exposes sorted by port along with the
+// first host binding of published ports
+function getPorts(container) {
+    var out = [];
+    var ports = container.NetworkSettings.Ports || {};
+    for (var key in ports) {
+        var parts = key.split("/");
+        var p = {
+            port: parseInt(parts[0]),
+            protocol: parts[1] || "tcp",
+            hostIp: "",
+            hostPort: 0
+        };
+
+        var bindings = ports[key];
+        if (bindings !== null && bindings.length > 0) {
+            p.hostIp = bindings[0].HostIp;
+            p.hostPort = parseInt(bindings[0].HostPort);
+            if (p.hostIp === "" || p.hostIp === "0.0.0.0") {
+                p.hostIp = defaultHost;
             }
         }
-    } 
-     
-    if (port === 0) {
-        port = 80; 
+        out.push(p);
     }
-    return port;
+
+    out.sort(function(a, b) {
+        return a.port - b.port;
+    });
+    return out;
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crosbymichael/log"
+	"github.com/crosbymichael/skydock/docker"
+	"github.com/robertkrimen/otto"
+	"github.com/skynetservices/skydns1/client"
+)
+
+var (
+	// pluginsLock guards plugins which is replaced when the plugin file is reloaded
+	pluginsLock = sync.RWMutex{}
+
+	// sampleContainer is run through reloaded plugins before they replace
+	// the running ones so a broken file does not stop registrations
+	sampleContainer = &docker.Container{
+		Id:    "0123456789ab",
+		Image: "crosbymichael/redis:latest",
+		Name:  "/redis1",
+		Config: &docker.ContainerConfig{
+			Hostname: "0123456789ab",
+			Image:    "crosbymichael/redis:latest",
+			Env:      []string{},
+			Labels:   map[string]string{},
+		},
+		HostConfig: &docker.HostConfig{NetworkMode: "default"},
+		NetworkSettings: &docker.NetworkSettings{
+			IpAddress: "172.17.0.2",
+			Ports:     map[string][]docker.Binding{"6379/tcp": {{HostIp: "0.0.0.0", HostPort: "49153"}}},
+			Networks: map[string]*docker.EndpointSettings{
+				"bridge": {IPAddress: "172.17.0.2"},
+			},
+		},
+		State: "running",
+	}
+)
+
+// currentPlugins returns the running plugins
+func currentPlugins() *pluginRuntime {
+	pluginsLock.RLock()
+	defer pluginsLock.RUnlock()
+
+	return plugins
+}
+
+// reloadPlugins compiles the plugin file and replaces the running plugins
+// if they work for the sample container.  The services of the registered
+// containers are updated afterwards so they reflect the new plugins.
+func reloadPlugins() error {
+	runtime, err := newRuntime(pluginFile, numberOfHandlers+1)
+	if err != nil {
+		return err
+	}
+	if err := validatePlugins(runtime); err != nil {
+		return err
+	}
+
+	pluginsLock.Lock()
+	plugins = runtime
+	pluginsLock.Unlock()
+
+	log.Logf(log.INFO, "reloaded plugins from %s", pluginFile)
+
+	for _, uuid := range registeredServices() {
+		if err := updateContainer(uuid); err != nil {
+			log.Logf(log.ERROR, "failed to update %s with the reloaded plugins, keeping its services: %s", uuid, err)
+		}
+	}
+	if err := reconcile(); err != nil {
+		log.Logf(log.ERROR, "error reconciling containers with the reloaded plugins: %s", err)
+	}
+	return nil
+}
+
+// validatePlugins checks that the file defines createService and runs the
+// plugins for the sample container.  Panics, timeouts and invalid services
+// would fail for every container so they reject the plugins, while an
+// Error thrown by a plugin that only handles some containers is just logged.
+func validatePlugins(r *pluginRuntime) error {
+	if !r.hasFunction("createService") {
+		return fmt.Errorf("%s does not define a createService function", pluginFile)
+	}
+	if _, err := r.shouldRegister(sampleContainer); err != nil {
+		if _, thrown := err.(*otto.Error); !thrown {
+			return fmt.Errorf("shouldRegister plugin failed for the sample container: %s", err)
+		}
+		log.Logf(log.INFO, "shouldRegister plugin failed for the sample container: %s", err)
+	}
+	if _, err := r.createServices(sampleContainer); err != nil {
+		if _, thrown := err.(*otto.Error); !thrown {
+			return fmt.Errorf("createService plugin failed for the sample container: %s", err)
+		}
+		log.Logf(log.INFO, "createService plugin failed for the sample container: %s", err)
+	}
+	return nil
+}
+
+// updateContainer registers the services that the plugins now create for
+// the container before it removes the ones they no longer create, so the
+// records do not drop out of skydns.  A changed service, even if only its
+// ttl changed, is deleted and added again as the backends cannot replace a
+// service under the same uuid and most of them ignore the ttl of updates.
+func updateContainer(uuid string) error {
+	container, err := dockerClient.FetchContainer(uuid, "")
+	if err != nil {
+		return err
+	}
+	// the image is only set, and resolved, when it is passed to docker
+	if container, err = dockerClient.FetchContainer(uuid, container.Config.Image); err != nil {
+		return err
+	}
+	services, err := buildServices(uuid, container)
+	if err != nil {
+		return err
+	}
+
+	stale := make(map[string]*Service)
+	for _, service := range containerServices(uuid) {
+		stale[service.UUID] = service
+	}
+
+	for _, service := range services {
+		old, exists := stale[service.UUID]
+		delete(stale, service.UUID)
+
+		switch {
+		case exists && sameService(old, service):
+			continue
+		case exists:
+			log.Logf(log.INFO, "replacing %s in skydns", service.UUID)
+			if err := skydns.Delete(service.UUID); err != nil && err != client.ErrServiceNotFound {
+				return err
+			}
+			fallthrough
+		default:
+			if err := sendService(service.UUID, service); err != nil {
+				return err
+			}
+		}
+		registerService(uuid, service)
+	}
+
+	for _, service := range stale {
+		log.Logf(log.INFO, "removing %s from skydns", service.UUID)
+		if err := skydns.Delete(service.UUID); err != nil && err != client.ErrServiceNotFound {
+			return err
+		}
+		heartbeats.remove(service.UUID)
+		forgetService(service.UUID)
+	}
+	return nil
+}
+
+// sameService returns true if the services are registered with the same records
+func sameService(a, b *Service) bool {
+	return a.Name == b.Name && a.Version == b.Version && a.Environment == b.Environment &&
+		a.Region == b.Region && a.Host == b.Host && a.Port == b.Port && a.TTL == b.TTL &&
+		a.Protocol == b.Protocol && a.ExposedPort == b.ExposedPort &&
+		a.Network == b.Network && a.Alias == b.Alias
+}
+
+// watchPlugins reloads the plugins when skydock receives SIGHUP or, if the
+// interval is not 0, when the plugin file changes
+func watchPlugins(interval time.Duration, hup <-chan os.Signal) {
+	defer background.Done()
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	last, _ := os.Stat(pluginFile)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-hup:
+			log.Logf(log.INFO, "received SIGHUP, reloading plugins")
+		case <-ticks:
+			info, err := os.Stat(pluginFile)
+			// editors can remove the file while saving it
+			if err != nil || !fileChanged(last, info) {
+				continue
+			}
+			log.Logf(log.INFO, "%s changed, reloading plugins", pluginFile)
+		}
+
+		last, _ = os.Stat(pluginFile)
+		if err := reloadPlugins(); err != nil {
+			log.Logf(log.ERROR, "error reloading plugins, keeping the running plugins: %s", err)
+		}
+	}
+}
+
+func fileChanged(last, info os.FileInfo) bool {
+	return last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size()
+}
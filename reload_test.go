@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/crosbymichael/skydock/docker"
+)
+
+func TestReloadPlugins(t *testing.T) {
+	f, err := ioutil.TempFile("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	defer func(v string) { pluginFile = v }(pluginFile)
+	pluginFile = f.Name()
+
+	writePlugin := func(service string, ttl string) {
+		script := `
+function createService(container) {
+    return {Port: 80, Environment: defaultEnvironment, TTL: ` + ttl + `, Service: "` + service + `", Instance: "1", Host: "10.0.0.1"};
+}
+`
+		if err := ioutil.WriteFile(pluginFile, []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(p *pluginRuntime, s Skydns, r map[string][]*Service, d docker.Docker) {
+		plugins, skydns, registered, dockerClient = p, s, r, d
+	}(plugins, skydns, registered, dockerClient)
+
+	writePlugin("app", "defaultTTL")
+	if plugins, err = newRuntime(pluginFile, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	mock := &mockSkydns{make(map[string]*Service)}
+	skydns = mock
+	registered = make(map[string][]*Service)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {Id: "1", Image: "app", Name: "/app", Config: &docker.ContainerConfig{Image: "app"}, NetworkSettings: &docker.NetworkSettings{}},
+		},
+	}
+
+	if err := addService("1", "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	writePlugin("web", "defaultTTL")
+	if err := reloadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	service := mock.services["1"]
+	if service == nil || service.Name != "web" {
+		t.Fatalf("Expected 1 to be registered as web got %v", service)
+	}
+
+	// an unchanged service is left alone
+	if err := reloadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	if mock.services["1"] != service {
+		t.Fatalf("Expected 1 to be kept got %v", mock.services["1"])
+	}
+
+	// a service that only changed its ttl is added again as most backends ignore the ttl of updates
+	writePlugin("web", "42")
+	if err := reloadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	if updated := mock.services["1"]; updated == service || updated.TTL != 42 {
+		t.Fatalf("Expected 1 to be added again with a ttl of 42 got %v", updated)
+	}
+	if h := heartbeats.beats["1"]; h == nil || h.ttl != 42 {
+		t.Fatalf("Expected the heartbeat of 1 to send a ttl of 42 got %v", h)
+	}
+	service = mock.services["1"]
+
+	running := currentPlugins()
+	for _, script := range []string{
+		"function createService(container) {",
+		"var services = [];",
+		"function createService(container) { return 1; }",
+	} {
+		if err := ioutil.WriteFile(pluginFile, []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadPlugins(); err == nil {
+			t.Fatalf("Expected error reloading %q", script)
+		}
+		if currentPlugins() != running {
+			t.Fatalf("Expected the running plugins to be kept for %q", script)
+		}
+	}
+
+	// plugins that fail for the containers are loaded but keep their services
+	if err := ioutil.WriteFile(pluginFile, []byte(`function createService(container) { throw new Error("broken"); }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	if currentPlugins() == running {
+		t.Fatal("Expected the plugins to be replaced")
+	}
+	if mock.services["1"] != service || len(containerServices("1")) != 1 {
+		t.Fatalf("Expected 1 to still be registered as web got %v", mock.services["1"])
+	}
+}
+
+func TestReloadPluginsImage(t *testing.T) {
+	defer func(p *pluginRuntime, s Skydns, r map[string][]*Service, d docker.Docker, f *containerFilter, file string) {
+		plugins, skydns, registered, dockerClient, filters, pluginFile = p, s, r, d, f, file
+	}(plugins, skydns, registered, dockerClient, filters, pluginFile)
+
+	// docker only returns the image of a container fetched with it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			fmt.Fprint(w, `[{"Id":"1","Image":"crosbymichael/redis:latest","Name":"/redis1"}]`)
+		case "/containers/1/json":
+			fmt.Fprint(w, `{"Id":"1","Name":"/redis1","Config":{"Image":"crosbymichael/redis:latest"},"NetworkSettings":{"IPAddress":"172.17.0.2"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var err error
+	if dockerClient, err = docker.NewClient("tcp://"+server.Listener.Addr().String(), nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if filters, err = newContainerFilter("image:crosbymichael/redis", ""); err != nil {
+		t.Fatal(err)
+	}
+	pluginFile = "plugins/default.js"
+	if plugins, err = newRuntime(pluginFile, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	mock := &mockSkydns{make(map[string]*Service)}
+	skydns = mock
+	registered = make(map[string][]*Service)
+
+	if err := addService("1", "crosbymichael/redis:latest"); err != nil {
+		t.Fatal(err)
+	}
+	services := containerServices("1")
+	if len(services) == 0 {
+		t.Fatal("Expected 1 to be registered")
+	}
+
+	if err := reloadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range services {
+		if mock.services[service.UUID] != service || service.Name != "redis" {
+			t.Fatalf("Expected %s to be kept as redis got %v", service.UUID, mock.services[service.UUID])
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/client"
+)
+
+// rfc2136Client is a Skydns implementation that sends RFC 2136 dynamic
+// updates signed with TSIG to the primary nameserver of the domain
+type rfc2136Client struct {
+	sync.Mutex
+
+	server    string
+	zone      string
+	keyName   string
+	algorithm string
+	client    *dns.Client
+	records   map[string][]dns.RR // uuid -> records added
+}
+
+// newRFC2136Client returns a client for the nameserver.  The key is in
+// the format used by nsupdate -y, [algorithm:]name:secret, and updates
+// are not signed if it is empty.
+func newRFC2136Client(server, zone, key string) (*rfc2136Client, error) {
+	c := &rfc2136Client{
+		server:  server,
+		zone:    dns.Fqdn(strings.ToLower(zone)),
+		client:  &dns.Client{Net: "tcp", Timeout: 10 * time.Second},
+		records: make(map[string][]dns.RR),
+	}
+
+	if key != "" {
+		parts := strings.Split(key, ":")
+		switch len(parts) {
+		case 2:
+			c.algorithm, c.keyName = dns.HmacSHA256, parts[0]
+		case 3:
+			c.algorithm, c.keyName = dns.Fqdn(strings.ToLower(parts[0])), parts[1]
+		default:
+			return nil, fmt.Errorf("invalid tsig key, expected [algorithm:]name:secret")
+		}
+		c.keyName = dns.Fqdn(c.keyName)
+		c.client.TsigSecret = map[string]string{c.keyName: parts[len(parts)-1]}
+	}
+	return c, nil
+}
+
+func (c *rfc2136Client) Add(uuid string, service *Service) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, exists := c.records[uuid]; exists {
+		return client.ErrConflictingUUID
+	}
+
+	// the ipv4 and ipv6 services of a container share their SRV records
+	var (
+		records = c.serviceRecords(service)
+		shared  = c.sharedRecords(uuid)
+		insert  []dns.RR
+	)
+	for _, rr := range records {
+		if !shared[recordKey(rr)] {
+			insert = append(insert, rr)
+		}
+	}
+
+	if len(insert) > 0 {
+		if err := c.update(insert, nil); err != nil {
+			return err
+		}
+	}
+	c.records[uuid] = records
+	return nil
+}
+
+// Delete removes the records of the service that are not
+// shared with any other service
+func (c *rfc2136Client) Delete(uuid string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	records, exists := c.records[uuid]
+	if !exists {
+		return client.ErrServiceNotFound
+	}
+
+	var (
+		shared = c.sharedRecords(uuid)
+		remove []dns.RR
+	)
+	for _, rr := range records {
+		if !shared[recordKey(rr)] {
+			remove = append(remove, rr)
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := c.update(nil, remove); err != nil {
+			return err
+		}
+	}
+	delete(c.records, uuid)
+	return nil
+}
+
+// Update sends the records of the service again with the ttl so that
+// records lost on the nameserver are restored
+func (c *rfc2136Client) Update(uuid string, ttl uint32) error {
+	c.Lock()
+	defer c.Unlock()
+
+	records, exists := c.records[uuid]
+	if !exists {
+		return client.ErrServiceNotFound
+	}
+	for _, rr := range records {
+		rr.Header().Ttl = ttl
+	}
+	return c.update(records, nil)
+}
+
+// sharedRecords returns the records of all the services other than uuid
+func (c *rfc2136Client) sharedRecords(uuid string) map[string]bool {
+	shared := make(map[string]bool)
+	for other, rrs := range c.records {
+		if other == uuid {
+			continue
+		}
+		for _, rr := range rrs {
+			shared[recordKey(rr)] = true
+		}
+	}
+	return shared
+}
+
+// recordKey identifies records that only differ by their ttl, which Update
+// changes for the records of one service but not the ones it shares
+func recordKey(rr dns.RR) string {
+	if srv, ok := rr.(*dns.SRV); ok {
+		return srvKey(srv)
+	}
+	key := dns.Copy(rr)
+	key.Header().Ttl = 0
+	return key.String()
+}
+
+func (c *rfc2136Client) serviceRecords(service *Service) []dns.RR {
+	var records []dns.RR
+	for _, name := range []string{instanceName(service, c.zone), serviceName(service, c.zone)} {
+		if rr := addressRecord(name, service); rr != nil {
+			records = append(records, rr)
+		}
+	}
+	return append(records, srvRecord(service, c.zone))
+}
+
+// update sends an update message that inserts and removes the records
+func (c *rfc2136Client) update(insert, remove []dns.RR) error {
+	m := new(dns.Msg)
+	m.SetUpdate(c.zone)
+	// Remove and Insert change the class of the records so use copies
+	for _, rr := range remove {
+		m.Remove([]dns.RR{dns.Copy(rr)})
+	}
+	for _, rr := range insert {
+		m.Insert([]dns.RR{dns.Copy(rr)})
+	}
+	if c.keyName != "" {
+		m.SetTsig(c.keyName, c.algorithm, 300, time.Now().Unix())
+	}
+
+	resp, _, err := c.client.Exchange(m, c.server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of %s refused by %s: %s", c.zone, c.server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
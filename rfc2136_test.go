@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// fakePrimary applies signed dynamic updates to an in memory zone
+type fakePrimary struct {
+	sync.Mutex
+
+	records map[string]dns.RR
+	inserts map[uint16]int
+}
+
+func (p *fakePrimary) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	p.Lock()
+	defer p.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		m.SetRcode(req, dns.RcodeNotAuth)
+	} else {
+		for _, rr := range req.Ns {
+			key := dns.Copy(rr)
+			key.Header().Class, key.Header().Ttl = dns.ClassINET, 0
+
+			switch rr.Header().Class {
+			case dns.ClassINET:
+				p.records[key.String()] = rr
+				p.inserts[rr.Header().Rrtype]++
+			case dns.ClassNONE:
+				delete(p.records, key.String())
+			}
+		}
+	}
+	if tsig := req.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+func TestRFC2136Client(t *testing.T) {
+	const key = "c2VjcmV0"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		primary = &fakePrimary{records: make(map[string]dns.RR), inserts: make(map[uint16]int)}
+		started = make(chan struct{})
+		server  = &dns.Server{
+			Listener:          l,
+			Handler:           primary,
+			TsigSecret:        map[string]string{"skydock.": key},
+			NotifyStartedFunc: func() { close(started) },
+			MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		}
+	)
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	c, err := newRFC2136Client(l.Addr().String(), "docker", "skydock:"+key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redis := func(version, host string) *Service {
+		return &Service{
+			Service:     msg.Service{Name: "redis", Version: version, Environment: "dev", Host: host, Port: 6379, TTL: 30},
+			Protocol:    "tcp",
+			ExposedPort: 6379,
+		}
+	}
+
+	if err := c.Add("1-6379-tcp", redis("redis1", "172.17.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("2-6379-tcp", redis("redis2", "172.17.0.3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 A records for each instance and service and 1 SRV for each
+	if len(primary.records) != 6 {
+		t.Fatalf("Expected 6 records got %d", len(primary.records))
+	}
+
+	// the ipv6 service of redis1 only adds AAAA records
+	if err := c.Add("1-ipv6-6379-tcp", redis("redis1", "fd00::2")); err != nil {
+		t.Fatal(err)
+	}
+	if primary.inserts[dns.TypeSRV] != 2 || primary.inserts[dns.TypeAAAA] != 2 {
+		t.Fatalf("Expected the SRV record not to be sent again got %v", primary.inserts)
+	}
+	if err := c.Delete("1-ipv6-6379-tcp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.records) != 6 {
+		t.Fatalf("Expected the shared SRV record to be kept got %d records", len(primary.records))
+	}
+
+	// the shared SRV record is still kept once the ipv4 service has a different ttl
+	if err := c.Add("1-ipv6-6379-tcp", redis("redis1", "fd00::2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update("1-6379-tcp", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("1-ipv6-6379-tcp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.records) != 6 {
+		t.Fatalf("Expected the shared SRV record to be kept after an update got %d records", len(primary.records))
+	}
+
+	if err := c.Delete("1-6379-tcp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.records) != 3 {
+		t.Fatalf("Expected 3 records got %d", len(primary.records))
+	}
+
+	if err := c.Delete("1-6379-tcp"); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected ErrServiceNotFound got %v", err)
+	}
+
+	unsigned, err := newRFC2136Client(l.Addr().String(), "docker", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unsigned.Add("3-6379-tcp", redis("redis3", "172.17.0.4")); err == nil {
+		t.Fatal("Expected unsigned update to be refused")
+	}
+}
+
+func TestRFC2136Key(t *testing.T) {
+	c, err := newRFC2136Client("127.0.0.1:53", "docker", "hmac-sha512:skydock:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.algorithm != dns.HmacSHA512 || c.keyName != "skydock." {
+		t.Fatalf("Expected hmac-sha512. skydock. got %s %s", c.algorithm, c.keyName)
+	}
+
+	if _, err := newRFC2136Client("127.0.0.1:53", "docker", "c2VjcmV0"); err == nil {
+		t.Fatal("Expected error for key without a name")
+	}
+}
@@ -1,13 +1,80 @@
 package main
 
 import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/crosbymichael/log"
+	"github.com/skynetservices/skydns1/client"
 	"github.com/skynetservices/skydns1/msg"
 )
 
 // Interface to allow mocking of the
 // skydns client
 type Skydns interface {
-	Add(uuid string, service *msg.Service) error
+	Add(uuid string, service *Service) error
 	Delete(uuid string) error
 	Update(uuid string, ttl uint32) error
 }
+
+// Service is a single record registered for a container.  A container
+// gets one service for every port that it publishes or exposes.
+type Service struct {
+	msg.Service
+
+	// Protocol and ExposedPort name the SRV record of a service registered
+	// for a container port, _6379._tcp.redis.dev.docker for 6379/tcp.
+	// Protocol is empty for services not registered for a port.
+	Protocol    string
+	ExposedPort uint16
+
+	// Network is the docker network whose address the service is registered
+	// with, empty for the address of the default bridge on older dockers
+	Network string
+
+	// Alias is set on the copies of a service registered with one of the
+	// container's network aliases as the instance name
+	Alias bool
+}
+
+// serviceUUID returns the uuid used to register the service of a container
+// so that each network, address, port and alias of the container is a separate record.
+// In multihost mode the region is added so that uuids do not collide between hosts.
+func serviceUUID(uuid string, service *Service) string {
+	if region != "" {
+		uuid = fmt.Sprintf("%s-%s", region, uuid)
+	}
+	if service.Network != "" {
+		uuid = fmt.Sprintf("%s-%s", uuid, service.Network)
+	}
+	if ip := net.ParseIP(service.Host); ip != nil && ip.To4() == nil {
+		uuid = fmt.Sprintf("%s-ipv6", uuid)
+	}
+	if service.Protocol != "" {
+		uuid = fmt.Sprintf("%s-%d-%s", uuid, service.ExposedPort, service.Protocol)
+	}
+	if service.Alias {
+		uuid = fmt.Sprintf("%s-%s", uuid, service.Version)
+	}
+	return uuid
+}
+
+// skydnsClient adapts the skydns1 client to the Skydns interface.  Skydns1
+// has no names for ports so the services of a container are only returned
+// together in the SRV records of the service name.
+type skydnsClient struct {
+	*client.Client
+
+	portsOnce sync.Once
+}
+
+func (c *skydnsClient) Add(uuid string, service *Service) error {
+	if service.Protocol != "" {
+		c.portsOnce.Do(func() {
+			log.Logf(log.WARN, "skydns does not support SRV records for ports like _%d._%s, use the dns, etcd, zone or rfc2136 backend for them",
+				service.ExposedPort, service.Protocol)
+		})
+	}
+	return c.Client.Add(uuid, &service.Service)
+}